@@ -0,0 +1,282 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// registration describes a call to one of the rpc.Register
+// functions, along with the options chained onto it.
+type registration struct {
+	anon     bool
+	cache    string
+	funcname string
+	get      bool
+	name     string
+	pkgpath  string
+	pos      token.Position
+	version  int
+}
+
+var (
+	problems      = []string{}
+	registrations = []*registration{}
+)
+
+func problem(pos token.Position, format string, a ...interface{}) {
+	problems = append(problems, fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, a...)))
+}
+
+// findRegistrations collects the rpc.Register, RegisterGet and
+// RegisterVersion calls within the file, including those made
+// through an rpc.Namespace which is either converted inline or
+// assigned to a variable in the same file. The built-in
+// services registered within package rpc itself aren't
+// checked.
+func findRegistrations(fset *token.FileSet, f *ast.File, pkgpath string, imports map[string]string) {
+	rpcname := ""
+	for name, path := range imports {
+		if path == "espra/rpc" {
+			rpcname = name
+		}
+	}
+	if rpcname == "" {
+		return
+	}
+	namespaces := map[string]string{}
+	ast.Inspect(f, func(node ast.Node) bool {
+		var (
+			names  []*ast.Ident
+			values []ast.Expr
+		)
+		switch decl := node.(type) {
+		case *ast.AssignStmt:
+			for _, expr := range decl.Lhs {
+				ident, _ := expr.(*ast.Ident)
+				names = append(names, ident)
+			}
+			values = decl.Rhs
+		case *ast.ValueSpec:
+			names, values = decl.Names, decl.Values
+		default:
+			return true
+		}
+		for i, value := range values {
+			if i < len(names) && names[i] != nil {
+				if ns, ok := namespaceCall(value, rpcname); ok {
+					namespaces[names[i].Name] = ns
+				}
+			}
+		}
+		return true
+	})
+	ast.Inspect(f, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		prefix := ""
+		reg := &registration{}
+		for {
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if inner, ok := sel.X.(*ast.CallExpr); ok {
+				if ns, ok := namespaceCall(inner, rpcname); ok {
+					prefix = ns + "."
+				} else {
+					switch sel.Sel.Name {
+					case "Anon":
+						reg.anon = true
+					case "Cache":
+						if len(call.Args) == 1 {
+							reg.cache = cacheExpr(call.Args[0], rpcname)
+						}
+					}
+					call = inner
+					continue
+				}
+			} else if ident, ok := sel.X.(*ast.Ident); !ok {
+				return true
+			} else if ns, ok := namespaces[ident.Name]; ok {
+				prefix = ns + "."
+			} else if ident.Name != rpcname {
+				return true
+			}
+			reg.pos = fset.Position(call.Pos())
+			reg.version = 1
+			args := call.Args
+			switch sel.Sel.Name {
+			case "Register":
+			case "RegisterGet":
+				reg.get = true
+			case "RegisterVersion":
+				if len(args) != 3 {
+					return true
+				}
+				lit, ok := args[1].(*ast.BasicLit)
+				if !ok || lit.Kind != token.INT {
+					problem(reg.pos, "the version needs to be an integer literal so that it can be checked")
+					return false
+				}
+				reg.version, _ = strconv.Atoi(lit.Value)
+				args = []ast.Expr{args[0], args[2]}
+			default:
+				return true
+			}
+			if len(args) != 2 {
+				return true
+			}
+			break
+		}
+		args := call.Args
+		lit, ok := args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			problem(reg.pos, "the service name needs to be a string literal so that it can be checked")
+			return false
+		}
+		reg.name, _ = strconv.Unquote(lit.Value)
+		reg.name = prefix + reg.name
+		switch fn := args[len(args)-1].(type) {
+		case *ast.Ident:
+			reg.funcname = fn.Name
+			reg.pkgpath = pkgpath
+		case *ast.SelectorExpr:
+			if pkg, ok := fn.X.(*ast.Ident); ok {
+				reg.funcname = fn.Sel.Name
+				reg.pkgpath = imports[pkg.Name]
+			}
+		}
+		if reg.funcname == "" {
+			problem(reg.pos, "%s needs to be registered with a named function so that it can be checked", reg.name)
+			return false
+		}
+		registrations = append(registrations, reg)
+		return false
+	})
+}
+
+// namespaceCall returns the name of the namespace if the
+// expression is a conversion like rpc.Namespace("profile").
+func namespaceCall(expr ast.Expr, rpcname string) (string, bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return "", false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Namespace" {
+		return "", false
+	}
+	if ident, ok := sel.X.(*ast.Ident); !ok || ident.Name != rpcname {
+		return "", false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	ns, err := strconv.Unquote(lit.Value)
+	return ns, err == nil
+}
+
+// cacheExpr formats the cache duration so that the values in
+// doc comments and registrations can be compared, with the rpc
+// package referred to as rpc and integer literals normalised.
+func cacheExpr(expr ast.Expr, rpcname string) string {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.INT {
+			if n, err := strconv.ParseInt(e.Value, 0, 64); err == nil {
+				return strconv.FormatInt(n, 10)
+			}
+		}
+	case *ast.BinaryExpr:
+		return cacheExpr(e.X, rpcname) + " " + e.Op.String() + " " + cacheExpr(e.Y, rpcname)
+	case *ast.ParenExpr:
+		return "(" + cacheExpr(e.X, rpcname) + ")"
+	case *ast.SelectorExpr:
+		if ident, ok := e.X.(*ast.Ident); ok && ident.Name == rpcname {
+			return "rpc." + e.Sel.Name
+		}
+	}
+	return types.ExprString(expr)
+}
+
+// parseRegistrations finds the registrations in a file which
+// isn't otherwise parsed, e.g. the generated api.go.
+func parseRegistrations(pkgpath, filename string) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		return err
+	}
+	findRegistrations(fset, f, pkgpath, fileImports(f))
+	return nil
+}
+
+// check compares the services declared in doc comments with
+// the registrations and records any discrepancies.
+func check() {
+	docs := map[string]*Method{}
+	for i, m := range methods {
+		if i > 0 && !methodList(methods).Less(i-1, i) {
+			problem(m.pos, "%s has already been defined at %s", m.Name, methods[i-1].pos)
+		}
+		docs[m.pkgpath+"."+m.funcname] = m
+	}
+	registered := map[*Method]bool{}
+	seen := map[string]*registration{}
+	for _, r := range registrations {
+		key := fmt.Sprintf("%s/%v/%d", r.name, r.get, r.version)
+		if prev, exists := seen[key]; exists {
+			problem(r.pos, "%s has already been registered at %s", r.name, prev.pos)
+			continue
+		}
+		seen[key] = r
+		m, ok := docs[r.pkgpath+"."+r.funcname]
+		if !ok {
+			problem(r.pos, "%s is registered with %s.%s, which has no service doc comment", r.name, r.pkgpath, r.funcname)
+			continue
+		}
+		registered[m] = true
+		if m.Name != r.name {
+			problem(r.pos, "%s is registered with %s, whose doc comment at %s is for %s", r.name, r.funcname, m.pos, m.Name)
+			continue
+		}
+		if m.Get != r.get {
+			problem(r.pos, "%s is documented with get=%v but registered with get=%v", r.name, m.Get, r.get)
+		}
+		version := m.Version
+		if version == 0 {
+			version = 1
+		}
+		if version != r.version {
+			problem(r.pos, "%s is documented as version %d but registered as version %d", r.name, version, r.version)
+		}
+		if m.Anon != r.anon {
+			problem(r.pos, "%s is documented with anon=%v but registered with anon=%v", r.name, m.Anon, r.anon)
+		}
+		cache := ""
+		if m.Cache != "" {
+			cache = m.Cache
+			if expr, err := parser.ParseExpr(m.Cache); err == nil {
+				cache = cacheExpr(expr, "rpc")
+			}
+		}
+		if cache != r.cache {
+			problem(r.pos, "%s is documented with cache=%q but registered with cache=%q", r.name, cache, r.cache)
+		}
+	}
+	for _, m := range methods {
+		if !registered[m] {
+			problem(m.pos, "%s is documented on %s but never registered", m.Name, m.funcname)
+		}
+	}
+}
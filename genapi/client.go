@@ -0,0 +1,419 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var coffeeHeader = `# DO NOT EDIT.
+# Auto-generated API file.
+`
+
+var coffeeReserved = map[string]bool{
+	"and": true, "arguments": true, "break": true, "by": true, "case": true,
+	"catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true,
+	"else": true, "enum": true, "eval": true, "export": true, "extends": true,
+	"false": true, "finally": true, "for": true, "function": true, "if": true,
+	"implements": true, "import": true, "in": true, "instanceof": true,
+	"interface": true, "is": true, "isnt": true, "let": true, "loop": true,
+	"native": true, "new": true, "no": true, "not": true, "null": true,
+	"of": true, "off": true, "on": true, "or": true, "package": true,
+	"private": true, "protected": true, "public": true, "return": true,
+	"static": true, "super": true, "switch": true, "then": true, "this": true,
+	"throw": true, "true": true, "try": true, "typeof": true,
+	"undefined": true, "unless": true, "until": true, "var": true,
+	"void": true, "when": true, "while": true, "with": true, "yes": true,
+	"yield": true,
+}
+
+// coffeeClientPrelude holds the transport for the generated
+// stubs. POST services call back with the error and replies,
+// with the response header as this. GET services return the
+// URL for the resource.
+var coffeeClientPrelude = `
+define 'espra', (exports, root) ->
+
+  local = root.localStorage
+
+  call = (name, version, args, callback) ->
+    header = {}
+    if token = local['auth.token']
+      header.auth = token
+    if version
+      header.version = version
+    xhr = new XMLHttpRequest()
+    xhr.open 'POST', '/_api', true
+    xhr.setRequestHeader 'Content-Type', 'application/json'
+    xhr.onreadystatechange = ->
+      return if xhr.readyState isnt 4
+      return if !callback
+      try
+        resp = JSON.parse xhr.responseText
+      catch err
+        callback code: 'internal_error', message: "invalid response for #{name}: #{xhr.status}"
+        return
+      if resp.error
+        callback.call resp.header, resp.error
+      else
+        callback.apply resp.header, [null].concat(resp.reply)
+      return
+    xhr.send JSON.stringify header: header, call: [name].concat(args)
+    return
+
+  url = (name, args) ->
+    path = '/_get/' + name
+    for arg in args
+      path += '/' + encodeURIComponent(if arg? then arg else '')
+    path
+
+  api = exports.api = {}
+
+  # setAuth sets the auth token that is sent with all calls.
+  # Passing a falsy token clears it.
+  api.setAuth = (token) ->
+    if token
+      local['auth.token'] = token
+    else
+      local.removeItem 'auth.token'
+    return
+`
+
+// goName returns the name of the Go client method for the
+// service, e.g. ProfileGravatarURL for profile.gravatar.
+func goName(m *Method) string {
+	name := ""
+	for _, part := range strings.FieldsFunc(m.Name, func(r rune) bool {
+		return r == '.' || r == '_' || r == '-'
+	}) {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	if m.Get {
+		name += "URL"
+	}
+	if m.Version > 1 {
+		name += "V" + strconv.Itoa(m.Version)
+	}
+	return name
+}
+
+func signature(m *Method) string {
+	in := make([]string, len(m.In))
+	for i, p := range m.In {
+		in[i] = p.Name + " " + p.Type
+	}
+	out := make([]string, len(m.Out))
+	for i, p := range m.Out {
+		out[i] = p.Type
+	}
+	sig := m.Name + "(" + strings.Join(in, ", ") + ")"
+	switch len(out) {
+	case 0:
+	case 1:
+		sig += " " + out[0]
+	default:
+		sig += " (" + strings.Join(out, ", ") + ")"
+	}
+	return sig
+}
+
+func writeComment(buf *bytes.Buffer, indent, prefix, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" {
+			fmt.Fprintf(buf, "%s%s\n", indent, prefix)
+		} else {
+			fmt.Fprintf(buf, "%s%s %s\n", indent, prefix, line)
+		}
+	}
+}
+
+// clientReserved holds the names defined by the hand-written
+// parts of the Go client package.
+var clientReserved = map[string]bool{
+	"Client": true, "Error": true, "Header": true, "New": true,
+}
+
+// clientTypes generates standalone definitions of the types
+// used by services, so that the Go client doesn't need to
+// import the app's packages, along with their App Engine
+// dependencies and init side effects. Types from packages
+// outside of the app, e.g. time.Time, are used as is.
+type clientTypes struct {
+	decls   map[string]string
+	imp     *sourceImporter
+	imports map[string]string
+	names   map[*types.TypeName]string
+}
+
+func (ct *clientTypes) goType(t types.Type) string {
+	switch t := t.(type) {
+	case *types.Basic:
+		if t.Kind() == types.Invalid {
+			ct.imports["encoding/json"] = "json"
+			return "json.RawMessage"
+		}
+		return t.Name()
+	case *types.Pointer:
+		elem := ct.goType(t.Elem())
+		if elem == "json.RawMessage" {
+			return elem
+		}
+		return "*" + elem
+	case *types.Slice:
+		return "[]" + ct.goType(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), ct.goType(t.Elem()))
+	case *types.Map:
+		return "map[" + ct.goType(t.Key()) + "]" + ct.goType(t.Elem())
+	case *types.Struct:
+		return ct.structType(t)
+	case *types.Named:
+		return ct.namedType(t)
+	}
+	return "interface{}"
+}
+
+// namedType returns the client name for the type, defining it
+// the first time that it's seen. Types which implement their
+// own JSON encoding are replaced by their wire format.
+func (ct *clientTypes) namedType(t *types.Named) string {
+	obj := t.Obj()
+	if obj.Pkg() == nil {
+		return obj.Name()
+	}
+	if path := obj.Pkg().Path(); !ct.imp.local(path) {
+		ct.imports[path] = obj.Pkg().Name()
+		return obj.Pkg().Name() + "." + obj.Name()
+	}
+	if name, exists := ct.names[obj]; exists {
+		return name
+	}
+	switch marshalKind(t) {
+	case "any":
+		ct.imports["encoding/json"] = "json"
+		return "json.RawMessage"
+	case "string":
+		return "string"
+	}
+	name := obj.Name()
+	if _, taken := ct.decls[name]; taken || clientReserved[name] {
+		pkgname := obj.Pkg().Name()
+		name = strings.ToUpper(pkgname[:1]) + pkgname[1:] + name
+	}
+	ct.names[obj] = name
+	ct.decls[name] = ""
+	ct.decls[name] = fmt.Sprintf("// %s mirrors %s.%s.\ntype %s %s\n", name, obj.Pkg().Name(), obj.Name(), name, ct.goType(t.Underlying()))
+	return name
+}
+
+// structType returns the definition of a struct with the same
+// JSON encoding as the given one.
+func (ct *clientTypes) structType(s *types.Struct) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("struct {\n")
+	for i := 0; i < s.NumFields(); i++ {
+		field := s.Field(i)
+		tag := reflect.StructTag(s.Tag(i)).Get("json")
+		if tag == "-" || !field.Exported() {
+			continue
+		}
+		if field.Anonymous() {
+			buf.WriteString(ct.goType(field.Type()))
+		} else {
+			fmt.Fprintf(buf, "%s %s", field.Name(), ct.goType(field.Type()))
+		}
+		if tag != "" {
+			fmt.Fprintf(buf, " `json:%q`", tag)
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// paramType returns the client type for the param, falling
+// back to interface{} if its type couldn't be resolved.
+func (ct *clientTypes) paramType(p Param) string {
+	if p.typ == nil {
+		return "interface{}"
+	}
+	return ct.goType(p.typ)
+}
+
+// genGoClient generates the source of the file which defines
+// the typed methods of the Go client package, along with the
+// types used by them.
+func genGoClient(pkgname string, imp *sourceImporter) ([]byte, error) {
+	ct := &clientTypes{
+		decls:   map[string]string{},
+		imp:     imp,
+		imports: map[string]string{},
+		names:   map[*types.TypeName]string{},
+	}
+	names := map[string]*Method{}
+	buf := &bytes.Buffer{}
+	for _, m := range methods {
+		name := goName(m)
+		if prev, exists := names[name]; exists {
+			return nil, fmt.Errorf("%s: the client method %s for %s clashes with the one for %s", m.pos, name, m.Name, prev.Name)
+		}
+		names[name] = m
+		doc := m.Doc
+		if m.Get {
+			doc = fmt.Sprintf("%s returns the URL for the %s service.\n\n%s", name, m.Name, doc)
+		} else if strings.HasPrefix(doc, m.funcname+" ") {
+			doc = name + doc[len(m.funcname):]
+		} else {
+			doc = fmt.Sprintf("%s calls the %s service.\n\n%s", name, m.Name, doc)
+		}
+		if m.Deprecated {
+			doc += "\n\nThis version of the service has been deprecated."
+		}
+		buf.WriteString("\n")
+		writeComment(buf, "", "//", strings.TrimSpace(doc))
+		taken := map[string]bool{"c": true, "err": true}
+		for i := range m.Out {
+			taken["r"+strconv.Itoa(i)] = true
+		}
+		params := make([]string, len(m.In))
+		args := make([]string, len(m.In))
+		for i, p := range m.In {
+			arg := p.Name
+			if taken[arg] || token.Lookup(arg).IsKeyword() {
+				arg += "Arg"
+			}
+			params[i] = arg + " " + ct.paramType(p)
+			args[i] = arg
+		}
+		fmt.Fprintf(buf, "func (c *Client) %s(%s) ", name, strings.Join(params, ", "))
+		if m.Get {
+			fmt.Fprintf(buf, "string {\n\treturn c.URL(%q", m.Name)
+			for _, arg := range args {
+				buf.WriteString(", " + arg)
+			}
+			buf.WriteString(")\n}\n")
+			continue
+		}
+		results := make([]string, len(m.Out))
+		replies := ""
+		for i, p := range m.Out {
+			results[i] = fmt.Sprintf("r%d %s", i, ct.paramType(p))
+			replies += fmt.Sprintf(", &r%d", i)
+		}
+		results = append(results, "err error")
+		argList := "nil"
+		if len(args) > 0 {
+			argList = "[]interface{}{" + strings.Join(args, ", ") + "}"
+		}
+		fmt.Fprintf(buf, "(%s) {\n", strings.Join(results, ", "))
+		if m.Version > 1 {
+			fmt.Fprintf(buf, "\terr = c.CallVersion(%q, %d, %s%s)\n", m.Name, m.Version, argList, replies)
+		} else {
+			fmt.Fprintf(buf, "\terr = c.Call(%q, %s%s)\n", m.Name, argList, replies)
+		}
+		buf.WriteString("\treturn\n}\n")
+	}
+	paths := []string{}
+	for path := range ct.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	decls := []string{}
+	for name := range ct.decls {
+		decls = append(decls, name)
+	}
+	sort.Strings(decls)
+	src := &bytes.Buffer{}
+	fmt.Fprintf(src, "%s\npackage %s\n", header, pkgname)
+	if len(paths) > 0 {
+		src.WriteString("\nimport (\n")
+		for _, path := range paths {
+			if name := ct.imports[path]; name != path[strings.LastIndex(path, "/")+1:] {
+				fmt.Fprintf(src, "\t%s %q\n", name, path)
+			} else {
+				fmt.Fprintf(src, "\t%q\n", path)
+			}
+		}
+		src.WriteString(")\n")
+	}
+	for _, name := range decls {
+		src.WriteString("\n" + ct.decls[name])
+	}
+	src.Write(buf.Bytes())
+	return format.Source(src.Bytes())
+}
+
+// genCoffeeClient generates the CoffeeScript source which
+// defines the stubs on the api object, with nested objects
+// for each component of the dotted service names. Versions
+// after the first are set as v2, v3, etc. on the stub.
+func genCoffeeClient() ([]byte, error) {
+	defined := map[string]bool{}
+	buf := &bytes.Buffer{}
+	buf.WriteString(coffeeHeader)
+	buf.WriteString(coffeeClientPrelude)
+	for _, m := range methods {
+		path := strings.Split(m.Name, ".")
+		if m.Version > 1 {
+			path = append(path, "v"+strconv.Itoa(m.Version))
+		}
+		for i := range path[:len(path)-1] {
+			parent := strings.Join(path[:i+1], ".")
+			if !defined[parent] {
+				fmt.Fprintf(buf, "\n  api.%s or= {}\n", parent)
+				defined[parent] = true
+			}
+		}
+		name := strings.Join(path, ".")
+		if defined[name] {
+			return nil, fmt.Errorf("%s: the client stub api.%s has already been defined", m.pos, name)
+		}
+		defined[name] = true
+		buf.WriteString("\n")
+		writeComment(buf, "  ", "#", signature(m))
+		schemas := []string{}
+		for _, p := range m.In {
+			if p.Kind == "array" || p.Kind == "object" {
+				schemas = append(schemas, p.Name+": "+p.Schema())
+			}
+		}
+		for i, p := range m.Out {
+			if p.Kind == "array" || p.Kind == "object" {
+				schemas = append(schemas, fmt.Sprintf("reply %d: %s", i, p.Schema()))
+			}
+		}
+		if len(schemas) > 0 {
+			buf.WriteString("  #\n")
+			writeComment(buf, "  ", "#  ", strings.Join(schemas, "\n"))
+		}
+		if m.Doc != "" {
+			buf.WriteString("  #\n")
+			writeComment(buf, "  ", "#", m.Doc)
+		}
+		args := make([]string, len(m.In))
+		for i, p := range m.In {
+			args[i] = p.Name
+			if coffeeReserved[args[i]] {
+				args[i] += "_"
+			}
+		}
+		if m.Get {
+			fmt.Fprintf(buf, "  api.%s = (%s) ->\n    url '%s', [%s]\n", name, strings.Join(args, ", "), m.Name, strings.Join(args, ", "))
+			continue
+		}
+		fmt.Fprintf(buf, "  api.%s = (%s) ->\n", name, strings.Join(append(args, "callback"), ", "))
+		fmt.Fprintf(buf, "    call '%s', %d, [%s], callback\n", m.Name, m.Version, strings.Join(args, ", "))
+	}
+	buf.WriteString("\n  return\n")
+	return buf.Bytes(), nil
+}
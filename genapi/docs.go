@@ -0,0 +1,175 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+)
+
+type namespace struct {
+	Name    string
+	Methods []*Method
+}
+
+// namespaces groups the methods by the first component of
+// their dotted names, relying on them already being sorted.
+func namespaces() []*namespace {
+	groups := []*namespace{}
+	for _, m := range methods {
+		name := strings.Split(m.Name, ".")[0]
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, &namespace{Name: name})
+		}
+		group := groups[len(groups)-1]
+		group.Methods = append(group.Methods, m)
+	}
+	return groups
+}
+
+// Anchor returns the fragment identifier for the method.
+func (m *Method) Anchor() string {
+	anchor := m.Name
+	if m.Get {
+		anchor += "-get"
+	}
+	if m.Version > 1 {
+		anchor += fmt.Sprintf("-v%d", m.Version)
+	}
+	return anchor
+}
+
+// Anonymous returns whether the method can be called without
+// authentication. GET services are always served anonymously.
+func (m *Method) Anonymous() bool {
+	return m.Anon || m.Get
+}
+
+// CacheInfo describes how long responses can be cached for.
+func (m *Method) CacheInfo() string {
+	switch {
+	case m.Cache == "":
+		return "no"
+	case m.maxAge > 0:
+		return fmt.Sprintf("%s (%ds)", m.Cache, m.maxAge)
+	}
+	return m.Cache
+}
+
+// Options lists the remaining options that callers need to be
+// aware of.
+func (m *Method) Options() []string {
+	opts := []string{}
+	if m.Version > 0 {
+		opts = append(opts, fmt.Sprintf("version %d", m.Version))
+	}
+	if m.Deprecated {
+		opts = append(opts, "deprecated")
+	}
+	if m.Scopes != nil {
+		opts = append(opts, "scopes: "+strings.Join(m.Scopes, " "))
+	}
+	if m.Idempotent != "" {
+		opts = append(opts, "idempotent for "+m.Idempotent)
+	}
+	if m.RateLimit != "" {
+		opts = append(opts, "rate limited to "+m.RateLimit)
+	}
+	if m.Timeout != "" {
+		opts = append(opts, "times out after "+m.Timeout)
+	}
+	return opts
+}
+
+func yesno(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+var docFuncs = map[string]interface{}{
+	"join":  strings.Join,
+	"yesno": yesno,
+}
+
+var markdownTemplate = template.Must(template.New("markdown").Funcs(docFuncs).Parse(`# API Reference
+{{range .}}
+## {{.Name}}
+{{range .Methods}}
+### {{.Name}}{{if .Get}} (GET){{end}}{{if gt .Version 1}} (v{{.Version}}){{end}}
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+- Anon: {{yesno .Anonymous}}
+- GET: {{yesno .Get}}
+- Cache: {{.CacheInfo}}{{with .Options}}
+- Options: {{join . ", "}}{{end}}
+{{if .In}}
+Params:
+
+| Name | Type | Schema |
+| ---- | ---- | ------ |
+{{range .In}}| {{.Name}} | ` + "`{{.Type}}`" + ` | ` + "`{{.Schema}}`" + ` |
+{{end}}{{end}}{{if .Out}}
+Results:
+
+| Type | Schema |
+| ---- | ------ |
+{{range .Out}}| ` + "`{{.Type}}`" + ` | ` + "`{{.Schema}}`" + ` |
+{{end}}{{end}}{{end}}{{end}}`))
+
+var htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Funcs(docFuncs).Parse(`<!doctype html>
+<meta charset="utf-8">
+<title>API Reference</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 50em; }
+code, pre { font-family: monospace; }
+pre { white-space: pre-wrap; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ddd; padding: 0.3em 0.6em; text-align: left; }
+.meta { color: #666; }
+</style>
+<h1>API Reference</h1>
+<ul>
+{{range .}}<li><a href="#ns-{{.Name}}">{{.Name}}</a>
+<ul>{{range .Methods}}<li><a href="#{{.Anchor}}">{{.Name}}</a>{{if .Get}} (GET){{end}}{{if gt .Version 1}} (v{{.Version}}){{end}}</li>{{end}}</ul>
+</li>
+{{end}}</ul>
+{{range .}}<h2 id="ns-{{.Name}}">{{.Name}}</h2>
+{{range .Methods}}<h3 id="{{.Anchor}}">{{.Name}}{{if .Get}} (GET){{end}}{{if gt .Version 1}} (v{{.Version}}){{end}}</h3>
+{{if .Doc}}<pre>{{.Doc}}</pre>
+{{end}}<p class="meta">Anon: {{yesno .Anonymous}} &middot; GET: {{yesno .Get}} &middot; Cache: {{.CacheInfo}}{{with .Options}} &middot; {{join . ", "}}{{end}}</p>
+{{if .In}}<table>
+<tr><th>Param</th><th>Type</th><th>Schema</th></tr>
+{{range .In}}<tr><td>{{.Name}}</td><td><code>{{.Type}}</code></td><td><code>{{.Schema}}</code></td></tr>
+{{end}}</table>
+{{end}}{{if .Out}}<table>
+<tr><th>Result</th><th>Schema</th></tr>
+{{range .Out}}<tr><td><code>{{.Type}}</code></td><td><code>{{.Schema}}</code></td></tr>
+{{end}}</table>
+{{end}}{{end}}{{end}}`))
+
+// genDocs generates the source of the file which holds the
+// HTML and Markdown API reference for serving from the app.
+func genDocs(pkgname string) ([]byte, error) {
+	groups := namespaces()
+	markdown := &bytes.Buffer{}
+	if err := markdownTemplate.Execute(markdown, groups); err != nil {
+		return nil, err
+	}
+	html := &bytes.Buffer{}
+	if err := htmlTemplate.Execute(html, groups); err != nil {
+		return nil, err
+	}
+	src := &bytes.Buffer{}
+	fmt.Fprintf(src, "%s\npackage %s\n\n", header, pkgname)
+	fmt.Fprintf(src, "var apiDocHTMLStr = %q\n\n", html.String())
+	fmt.Fprintf(src, "var apiDocMarkdownStr = %q\n", markdown.String())
+	return format.Source(src.Bytes())
+}
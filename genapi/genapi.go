@@ -4,42 +4,101 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/tav/golly/log"
 	"github.com/tav/golly/optparse"
 	"github.com/tav/golly/runtime"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var header = `// DO NOT EDIT.
 // Auto-generated API file.
 `
 
+// Param describes the wire format of a service argument or
+// result. Kind is one of any, array, boolean, number, object
+// or string. Arrays and maps have the schema of their values
+// in Elem, whilst structs have their fields keyed by their
+// JSON names in Struct.
 type Param struct {
-	Name   string           `json:"name"`
-	Struct map[string]Param `json:"struct"`
-	Type   string           `json:"type"`
+	typ      types.Type
+	Elem     *Param           `json:"elem,omitempty"`
+	Kind     string           `json:"kind"`
+	Name     string           `json:"name,omitempty"`
+	Optional bool             `json:"optional,omitempty"`
+	Struct   map[string]Param `json:"struct,omitempty"`
+	Type     string           `json:"type"`
 }
 
+// Method describes a service as specified by the header line
+// of the doc comment on its function, e.g.
+//
+//	// profile.gravatar(get, params=username size=150, cache)
+//
+// The supported options are anon, cache, cache=EXPR,
+// deprecated, get, idempotent=DURATION, params=SPECS,
+// ratelimit=N/DURATION, scopes=SCOPES, timeout=DURATION and
+// version=N. Multiple params and scopes are space separated.
 type Method struct {
-	cache    string
-	funcname string
-	pkgname  string
-	pkgpath  string
-	Anon     bool    `json:"anon"`
-	Doc      string  `json:"doc"`
-	In       []Param `json:"in"`
-	Name     string  `json:"name"`
-	Out      []Param `json:"out"`
+	funcname   string
+	maxAge     int64
+	pkgname    string
+	pkgpath    string
+	pos        token.Position
+	Anon       bool     `json:"anon"`
+	Cache      string   `json:"cache,omitempty"`
+	Deprecated bool     `json:"deprecated,omitempty"`
+	Doc        string   `json:"doc"`
+	Get        bool     `json:"get"`
+	Idempotent string   `json:"idempotent,omitempty"`
+	In         []Param  `json:"in"`
+	Name       string   `json:"name"`
+	Out        []Param  `json:"out"`
+	Params     []string `json:"params,omitempty"`
+	RateLimit  string   `json:"ratelimit,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+	Version    int      `json:"version,omitempty"`
 }
 
 var methods = []*Method{}
 
+type methodList []*Method
+
+func (l methodList) Len() int {
+	return len(l)
+}
+
+func (l methodList) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Get != b.Get {
+		return !a.Get
+	}
+	return a.Version < b.Version
+}
+
+func (l methodList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
 func contains(list []string, item string) bool {
 	for _, elem := range list {
 		if elem == item {
@@ -70,13 +129,16 @@ func parseDirectory(pkgname, pkgpath, dirpath string, ignore []string) error {
 		}
 		info, err := os.Stat(path)
 		if err != nil {
-			return err
+			log.Error("skipping %s: %s", path, err)
+			continue
 		}
 		if info.IsDir() {
-			parseDirectory(subpath, pkgpath+"/"+subpath, path, ignore)
+			if err := parseDirectory(subpath, pkgpath+"/"+subpath, path, ignore); err != nil {
+				return err
+			}
 			continue
 		}
-		if !strings.HasPrefix(subpath, ".") && strings.HasSuffix(subpath, ".go") {
+		if !strings.HasPrefix(subpath, ".") && strings.HasSuffix(subpath, ".go") && !strings.HasSuffix(subpath, "_test.go") {
 			files = append(files, path)
 		}
 	}
@@ -86,7 +148,28 @@ func parseDirectory(pkgname, pkgpath, dirpath string, ignore []string) error {
 	return parsePackage(pkgname, pkgpath, files)
 }
 
+// fileImports returns a map of the names that the file's
+// imports are referred by to their paths.
+func fileImports(f *ast.File) map[string]string {
+	imports := map[string]string{}
+	for _, spec := range f.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	return imports
+}
+
+// parsePackage adds the services defined within the package's
+// files. Packages which fail to parse are skipped with a
+// warning, unless they define services, so that unrelated
+// breakage doesn't stop the API from being generated.
 func parsePackage(pkgname, pkgpath string, filenames []string) error {
+	var perr error
+	found := []*Method{}
 	fset := token.NewFileSet()
 	for _, filename := range filenames {
 		src, err := ioutil.ReadFile(filename)
@@ -94,12 +177,17 @@ func parsePackage(pkgname, pkgpath string, filenames []string) error {
 			return err
 		}
 		f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
-		if err != nil {
-			return err
+		if err != nil && perr == nil {
+			perr = err
 		}
+		if f == nil {
+			continue
+		}
+		imports := fileImports(f)
+		findRegistrations(fset, f, pkgpath, imports)
 		for _, decl := range f.Decls {
 			funcdecl, ok := decl.(*ast.FuncDecl)
-			if !ok {
+			if !ok || funcdecl.Recv != nil {
 				continue
 			}
 			if funcdecl.Doc == nil {
@@ -121,7 +209,7 @@ func parsePackage(pkgname, pkgpath string, filenames []string) error {
 			if !ok {
 				continue
 			}
-			if !(sel.X.(*ast.Ident).Name == "rpc" && sel.Sel.Name == "Context") {
+			if ident, ok := sel.X.(*ast.Ident); !ok || ident.Name != "rpc" || sel.Sel.Name != "Context" {
 				continue
 			}
 			doclines := strings.Split(doc, "\n")
@@ -129,43 +217,343 @@ func parsePackage(pkgname, pkgpath string, filenames []string) error {
 			method := &Method{
 				pkgname: pkgname,
 				pkgpath: pkgpath,
+				pos:     fset.Position(funcdecl.Pos()),
 			}
+			var opts string
 			if strings.HasSuffix(def, ")") {
 				splitdef := strings.Split(def, "(")
 				if len(splitdef) != 2 {
 					continue
 				}
 				method.Name = splitdef[0]
-				splitdef = strings.Split(splitdef[1], ")")
-				if len(splitdef) != 2 && splitdef[1] == "" {
-					continue
-				}
-				for _, part := range strings.Split(splitdef[0], ",") {
-					switch part = strings.TrimSpace(part); {
-					case part == "anon":
-						method.Anon = true
-					case part == "cache":
-						method.cache = "rpc.LongCache"
-					case strings.HasPrefix(part, "cache="):
-						method.cache = part[6:]
-					}
-				}
+				opts = splitdef[1][:len(splitdef[1])-1]
 			} else {
 				method.Name = def
 			}
-			if strings.ContainsAny(method.Name, " ,") {
+			if method.Name == "" || strings.ContainsAny(method.Name, " ,") {
 				continue
 			}
+			if err := method.parseOptions(opts); err != nil {
+				return fmt.Errorf("%s: %s", method.pos, err)
+			}
+			if err := method.parseSignature(funcdecl.Type, imports); err != nil {
+				return fmt.Errorf("%s: %s", method.pos, err)
+			}
 			method.funcname = funcdecl.Name.String()
 			if len(doclines) > 1 {
 				method.Doc = strings.TrimSpace(strings.Join(doclines[1:], "\n"))
 			}
-			methods = append(methods, method)
+			found = append(found, method)
 		}
 	}
+	if perr != nil {
+		if len(found) > 0 {
+			return perr
+		}
+		log.Error("skipping the %s package: %s", pkgpath, perr)
+		return nil
+	}
+	methods = append(methods, found...)
 	return nil
 }
 
+func (m *Method) parseOptions(opts string) error {
+	for _, part := range strings.Split(opts, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value := part, ""
+		if idx := strings.Index(part, "="); idx != -1 {
+			key, value = strings.TrimSpace(part[:idx]), strings.TrimSpace(part[idx+1:])
+			if value == "" {
+				return fmt.Errorf("missing value for the %s option of %s", key, m.Name)
+			}
+		}
+		var err error
+		switch key {
+		case "anon":
+			m.Anon = true
+		case "cache":
+			m.Cache = "rpc.LongCache"
+			if value != "" {
+				m.Cache = value
+			}
+		case "deprecated":
+			m.Deprecated = true
+		case "get":
+			m.Get = true
+		case "idempotent":
+			m.Idempotent = value
+			_, err = time.ParseDuration(value)
+		case "params":
+			m.Params = strings.Fields(value)
+		case "ratelimit":
+			m.RateLimit = value
+			_, _, err = parseRateLimit(value)
+		case "scopes":
+			m.Scopes = strings.Fields(value)
+		case "timeout":
+			m.Timeout = value
+			_, err = time.ParseDuration(value)
+		case "version":
+			m.Version, err = strconv.Atoi(value)
+			if err == nil && m.Version < 1 {
+				err = fmt.Errorf("versions need to be positive")
+			}
+		default:
+			return fmt.Errorf("unknown option %q for %s", part, m.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s option for %s: %s", key, m.Name, err)
+		}
+	}
+	if m.Get && (m.Idempotent != "" || m.Scopes != nil || m.Version != 0) {
+		return fmt.Errorf("GET services like %s cannot be idempotent, versioned or have scopes", m.Name)
+	}
+	return nil
+}
+
+var predeclared = map[string]bool{
+	"bool": true, "byte": true, "complex64": true, "complex128": true,
+	"error": true, "float32": true, "float64": true, "int": true,
+	"int8": true, "int16": true, "int32": true, "int64": true,
+	"rune": true, "string": true, "uint": true, "uint8": true,
+	"uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+}
+
+// parseSignature sets the In and Out params from the function
+// signature, skipping the initial *rpc.Context and any
+// trailing error result. Types are qualified with their
+// package name so that they can be used outside of the
+// service's package.
+func (m *Method) parseSignature(ftype *ast.FuncType, imports map[string]string) error {
+	fields := func(list *ast.FieldList, skip int, prefix string) ([]Param, error) {
+		params := []Param{}
+		if list == nil {
+			return params, nil
+		}
+		for _, field := range list.List[skip:] {
+			typ, err := m.typeString(field.Type, imports)
+			if err != nil {
+				return nil, err
+			}
+			if len(field.Names) == 0 {
+				params = append(params, Param{Name: prefix + strconv.Itoa(len(params)), Type: typ})
+			}
+			for _, ident := range field.Names {
+				name := ident.Name
+				if name == "_" {
+					name = prefix + strconv.Itoa(len(params))
+				}
+				params = append(params, Param{Name: name, Type: typ})
+			}
+		}
+		return params, nil
+	}
+	var err error
+	if m.In, err = fields(ftype.Params, 1, "arg"); err != nil {
+		return err
+	}
+	if m.Out, err = fields(ftype.Results, 0, "r"); err != nil {
+		return err
+	}
+	if n := len(m.Out); n > 0 && m.Out[n-1].Type == "error" {
+		m.Out = m.Out[:n-1]
+	}
+	for i, spec := range m.Params {
+		if i < len(m.In) {
+			m.In[i].Name = strings.Split(spec, "=")[0]
+		}
+	}
+	return nil
+}
+
+func (m *Method) typeString(expr ast.Expr, imports map[string]string) (string, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if predeclared[t.Name] {
+			return t.Name, nil
+		}
+		if !ast.IsExported(t.Name) {
+			return "", fmt.Errorf("%s uses the unexported type %s", m.Name, t.Name)
+		}
+		return m.pkgname + "." + t.Name, nil
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok {
+			if _, ok := imports[pkg.Name]; ok {
+				return pkg.Name + "." + t.Sel.Name, nil
+			}
+		}
+	case *ast.StarExpr:
+		elem, err := m.typeString(t.X, imports)
+		return "*" + elem, err
+	case *ast.ArrayType:
+		elem, err := m.typeString(t.Elt, imports)
+		if t.Len == nil {
+			return "[]" + elem, err
+		}
+		if lit, ok := t.Len.(*ast.BasicLit); ok && lit.Kind == token.INT {
+			return "[" + lit.Value + "]" + elem, err
+		}
+	case *ast.MapType:
+		key, err := m.typeString(t.Key, imports)
+		if err != nil {
+			return "", err
+		}
+		value, err := m.typeString(t.Value, imports)
+		return "map[" + key + "]" + value, err
+	case *ast.InterfaceType:
+		if len(t.Methods.List) == 0 {
+			return "interface{}", nil
+		}
+	}
+	return "", fmt.Errorf("%s uses an unsupported type in its signature", m.Name)
+}
+
+// parseRateLimit parses rate limits of the form N/DURATION,
+// e.g. 10/1m.
+func parseRateLimit(value string) (int, time.Duration, error) {
+	idx := strings.Index(value, "/")
+	if idx == -1 {
+		return 0, 0, fmt.Errorf("needs to be of the form N/DURATION")
+	}
+	rate, err := strconv.Atoi(value[:idx])
+	if err != nil {
+		return 0, 0, err
+	}
+	per, err := time.ParseDuration(value[idx+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if rate <= 0 || per <= 0 {
+		return 0, 0, fmt.Errorf("needs a positive rate and period")
+	}
+	return rate, per, nil
+}
+
+// durationExpr returns a Go expression for the duration using
+// the largest time unit that it is a multiple of.
+func durationExpr(value string) string {
+	d, _ := time.ParseDuration(value)
+	for _, unit := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"time.Hour", time.Hour},
+		{"time.Minute", time.Minute},
+		{"time.Second", time.Second},
+		{"time.Millisecond", time.Millisecond},
+	} {
+		if d%unit.d == 0 {
+			if d == unit.d {
+				return unit.name
+			}
+			return fmt.Sprintf("%d * %s", d/unit.d, unit.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", d)
+}
+
+func quoteList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, elem := range list {
+		quoted[i] = strconv.Quote(elem)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// genRegistry generates the source of the file which registers
+// all of the services with the rpc package.
+func genRegistry(pkgname string) ([]byte, error) {
+	imports := map[string]string{"espra/rpc": "rpc"}
+	buf := &bytes.Buffer{}
+	for _, m := range methods {
+		fn := m.funcname
+		if m.pkgpath != pkgname {
+			if !ast.IsExported(fn) {
+				return nil, fmt.Errorf("%s: the function for %s needs to be exported", m.pos, m.Name)
+			}
+			for path, name := range imports {
+				if name == m.pkgname && path != m.pkgpath {
+					return nil, fmt.Errorf("%s: the package name %s is used by both %s and %s", m.pos, name, path, m.pkgpath)
+				}
+			}
+			imports[m.pkgpath] = m.pkgname
+			fn = m.pkgname + "." + fn
+		}
+		switch {
+		case m.Get:
+			fmt.Fprintf(buf, "\trpc.RegisterGet(%q, %s)", m.Name, fn)
+		case m.Version > 1:
+			fmt.Fprintf(buf, "\trpc.RegisterVersion(%q, %d, %s)", m.Name, m.Version, fn)
+		default:
+			fmt.Fprintf(buf, "\trpc.Register(%q, %s)", m.Name, fn)
+		}
+		if m.Anon {
+			buf.WriteString(".Anon()")
+		}
+		if m.Cache != "" {
+			fmt.Fprintf(buf, ".Cache(%s)", m.Cache)
+		}
+		if m.Params != nil {
+			fmt.Fprintf(buf, ".Params(%s)", quoteList(m.Params))
+		}
+		if m.Deprecated {
+			buf.WriteString(".Deprecated(\"\")")
+		}
+		if m.Idempotent != "" {
+			fmt.Fprintf(buf, ".Idempotent(%s)", durationExpr(m.Idempotent))
+			imports["time"] = "time"
+		}
+		if m.RateLimit != "" {
+			idx := strings.Index(m.RateLimit, "/")
+			fmt.Fprintf(buf, ".RateLimit(%s, %s)", m.RateLimit[:idx], durationExpr(m.RateLimit[idx+1:]))
+			imports["time"] = "time"
+		}
+		if m.Scopes != nil {
+			fmt.Fprintf(buf, ".Scopes(%s)", quoteList(m.Scopes))
+		}
+		if m.Timeout != "" {
+			fmt.Fprintf(buf, ".Timeout(%s)", durationExpr(m.Timeout))
+			imports["time"] = "time"
+		}
+		buf.WriteString("\n")
+	}
+	paths := []string{}
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	src := &bytes.Buffer{}
+	fmt.Fprintf(src, "%s\npackage %s\n\nimport (\n", header, pkgname)
+	for _, path := range paths {
+		fmt.Fprintf(src, "\t%q\n", path)
+	}
+	fmt.Fprintf(src, ")\n\nfunc init() {\n%s}\n", buf.Bytes())
+	return format.Source(src.Bytes())
+}
+
+// digest returns the hex-encoded SHA-1 hash of the JSON
+// encoding of the methods, so that any change to the API
+// results in a new version digest.
+func digest() (string, error) {
+	enc, err := json.Marshal(methods)
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.New()
+	hash.Write(enc)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
 func main() {
 
 	opts := optparse.Parser("Usage: genapi [options]", "0.1")
@@ -175,13 +563,25 @@ func main() {
 		"path to the root package directory for the app", "PATH")
 
 	ignoreList := opts.String(
-		[]string{"-i", "--ignore"}, "api.go html.go",
+		[]string{"-i", "--ignore"}, "api.go apidoc.go html.go",
 		"space-separated list of files/subdirectories to ignore", "LIST")
 
 	digestFile := opts.String(
 		[]string{"-d", "--digest"}, "../etc/app/version.digest",
 		"path to write the digest of the API version", "PATH")
 
+	coffeeClient := opts.String(
+		[]string{"--coffee-client"}, "../coffee/api.coffee",
+		"path to write the CoffeeScript client stubs", "PATH")
+
+	goClient := opts.String(
+		[]string{"--go-client"}, "../src/espra/client/api.go",
+		"path to write the methods of the Go client package", "PATH")
+
+	checkMode := opts.Bool(
+		[]string{"--check"}, false,
+		"check that the registered services match their doc comments instead of generating files")
+
 	os.Args[0] = "genapi"
 	opts.Parse(os.Args)
 	log.AddConsoleLogger()
@@ -198,11 +598,86 @@ func main() {
 		runtime.StandardError(err)
 	}
 
+	sort.Sort(methodList(methods))
+	if *checkMode {
+		apiFile := filepath.Join(*root, "api.go")
+		if _, err := os.Stat(apiFile); err == nil {
+			if err := parseRegistrations(pkgname, apiFile); err != nil {
+				runtime.StandardError(err)
+			}
+		}
+		check()
+		for _, msg := range problems {
+			log.Error("%s", msg)
+		}
+		if len(problems) > 0 {
+			runtime.Error("found %d problems with the API registry", len(problems))
+		}
+		log.Info("Checked %d services and %d registrations", len(methods), len(registrations))
+		log.Wait()
+		return
+	}
+
+	for i, method := range methods {
+		if i > 0 && !methodList(methods).Less(i-1, i) {
+			runtime.Error("%s: %s has already been defined at %s", method.pos, method.Name, methods[i-1].pos)
+		}
+	}
+
+	imp := newSourceImporter(filepath.Dir(*root))
 	for _, method := range methods {
-		log.Info("%#v", method)
+		if err := method.resolveTypes(imp); err != nil {
+			runtime.StandardError(err)
+		}
 	}
-	log.Wait()
 
-	_ = *digestFile
+	src, err := genRegistry(pkgname)
+	if err != nil {
+		runtime.StandardError(err)
+	}
+
+	apiFile := filepath.Join(*root, "api.go")
+	if err := writeFile(apiFile, src); err != nil {
+		runtime.StandardError(err)
+	}
+	log.Info("Generated %s with %d services", apiFile, len(methods))
+
+	src, err = genDocs(pkgname)
+	if err != nil {
+		runtime.StandardError(err)
+	}
+	docFile := filepath.Join(*root, "apidoc.go")
+	if err := writeFile(docFile, src); err != nil {
+		runtime.StandardError(err)
+	}
+	log.Info("Generated the API reference in %s", docFile)
+
+	src, err = genGoClient(filepath.Base(filepath.Dir(*goClient)), imp)
+	if err != nil {
+		runtime.StandardError(err)
+	}
+	if err := writeFile(*goClient, src); err != nil {
+		runtime.StandardError(err)
+	}
+	log.Info("Generated the Go client methods in %s", *goClient)
+
+	src, err = genCoffeeClient()
+	if err != nil {
+		runtime.StandardError(err)
+	}
+	if err := writeFile(*coffeeClient, src); err != nil {
+		runtime.StandardError(err)
+	}
+	log.Info("Generated the CoffeeScript client stubs in %s", *coffeeClient)
+
+	version, err := digest()
+	if err != nil {
+		runtime.StandardError(err)
+	}
+	if err := writeFile(*digestFile, []byte(version)); err != nil {
+		runtime.StandardError(err)
+	}
+	log.Info("Wrote API version digest %s to %s", version, *digestFile)
+	log.Wait()
 
 }
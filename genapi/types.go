@@ -0,0 +1,272 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// sourceImporter type-checks packages from source if they can
+// be found within the app's source directory, and falls back
+// to the compiled packages of the standard library otherwise.
+// Type errors are ignored, so that packages which depend on
+// the App Engine SDK can still be resolved, albeit with any
+// unresolvable types marked as invalid.
+type sourceImporter struct {
+	fset   *token.FileSet
+	pkgs   map[string]*types.Package
+	srcdir string
+	std    types.Importer
+}
+
+func newSourceImporter(srcdir string) *sourceImporter {
+	return &sourceImporter{
+		fset:   token.NewFileSet(),
+		pkgs:   map[string]*types.Package{},
+		srcdir: srcdir,
+		std:    importer.Default(),
+	}
+}
+
+func (imp *sourceImporter) Import(path string) (*types.Package, error) {
+	if pkg, exists := imp.pkgs[path]; exists {
+		if pkg == nil {
+			return nil, fmt.Errorf("import cycle via %s", path)
+		}
+		return pkg, nil
+	}
+	dir := filepath.Join(imp.srcdir, filepath.FromSlash(path))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return imp.std.Import(path)
+	}
+	bpkg, err := build.Default.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	files := []*ast.File{}
+	for _, filename := range bpkg.GoFiles {
+		f, err := parser.ParseFile(imp.fset, filepath.Join(dir, filename), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	imp.pkgs[path] = nil
+	conf := &types.Config{Importer: imp, Error: func(error) {}}
+	pkg, _ := conf.Check(path, imp.fset, files, nil)
+	imp.pkgs[path] = pkg
+	return pkg, nil
+}
+
+// local returns whether the package was type-checked from the
+// app's source directory.
+func (imp *sourceImporter) local(path string) bool {
+	return imp.pkgs[path] != nil
+}
+
+// resolveTypes fills in the wire format of the In and Out
+// params from the type-checked signature of the function.
+func (m *Method) resolveTypes(imp *sourceImporter) error {
+	pkg, err := imp.Import(m.pkgpath)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't type check %s: %s", m.pos, m.pkgpath, err)
+	}
+	fn, ok := pkg.Scope().Lookup(m.funcname).(*types.Func)
+	if !ok {
+		return fmt.Errorf("%s: couldn't resolve the function for %s", m.pos, m.Name)
+	}
+	if m.Cache != "" {
+		if tv, err := types.Eval(imp.fset, pkg, fn.Pos(), m.Cache); err == nil && tv.Value != nil {
+			m.maxAge, _ = constant.Int64Val(tv.Value)
+		}
+	}
+	sig := fn.Type().(*types.Signature)
+	for i := range m.In {
+		if i+1 < sig.Params().Len() {
+			m.In[i].resolve(sig.Params().At(i+1).Type(), map[*types.Named]bool{})
+		}
+	}
+	for i := range m.Out {
+		if i < sig.Results().Len() {
+			m.Out[i].resolve(sig.Results().At(i).Type(), map[*types.Named]bool{})
+		}
+	}
+	return nil
+}
+
+func qualifier(pkg *types.Package) string {
+	return pkg.Name()
+}
+
+// marshalKind returns the kind of the wire format for types
+// which implement their own JSON encoding, or an empty string
+// for all other types.
+func marshalKind(t *types.Named) string {
+	if obj := t.Obj(); obj.Pkg() != nil && obj.Pkg().Path() == "time" && obj.Name() == "Time" {
+		return "string"
+	}
+	ptr := types.NewPointer(t)
+	if obj, _, _ := types.LookupFieldOrMethod(ptr, true, nil, "MarshalJSON"); obj != nil {
+		if _, ok := obj.(*types.Func); ok {
+			return "any"
+		}
+	}
+	if obj, _, _ := types.LookupFieldOrMethod(ptr, true, nil, "MarshalText"); obj != nil {
+		if _, ok := obj.(*types.Func); ok {
+			return "string"
+		}
+	}
+	return ""
+}
+
+// resolve sets the schema of the param for the given type.
+// The seen set guards against recursing into self-referential
+// types, which are only described by their type name.
+func (p *Param) resolve(t types.Type, seen map[*types.Named]bool) {
+	p.typ = t
+	if p.Type == "" {
+		p.Type = types.TypeString(t, qualifier)
+	}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		if kind := marshalKind(named); kind != "" {
+			p.Kind = kind
+			return
+		}
+		if seen[named] {
+			p.Kind = "object"
+			return
+		}
+		seen[named] = true
+		defer delete(seen, named)
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			p.Kind = "boolean"
+		case u.Info()&types.IsNumeric != 0:
+			p.Kind = "number"
+		case u.Info()&types.IsString != 0:
+			p.Kind = "string"
+		default:
+			p.Kind = "any"
+		}
+	case *types.Slice:
+		if b, ok := u.Elem().Underlying().(*types.Basic); ok && b.Kind() == types.Byte {
+			p.Kind = "string"
+			return
+		}
+		p.Kind = "array"
+		p.Elem = &Param{}
+		p.Elem.resolve(u.Elem(), seen)
+	case *types.Array:
+		p.Kind = "array"
+		p.Elem = &Param{}
+		p.Elem.resolve(u.Elem(), seen)
+	case *types.Map:
+		p.Kind = "object"
+		p.Elem = &Param{}
+		p.Elem.resolve(u.Elem(), seen)
+	case *types.Struct:
+		p.Kind = "object"
+		p.Struct = map[string]Param{}
+		p.addFields(u, seen)
+	default:
+		p.Kind = "any"
+	}
+}
+
+// addFields adds the fields of the struct as they would be
+// encoded by the encoding/json package, i.e. using the names
+// from json tags, skipping unexported and "-" fields, and
+// promoting the fields of untagged embedded structs.
+func (p *Param) addFields(s *types.Struct, seen map[*types.Named]bool) {
+	for i := 0; i < s.NumFields(); i++ {
+		field := s.Field(i)
+		tag := reflect.StructTag(s.Tag(i)).Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if field.Anonymous() && name == "" {
+			t := field.Type()
+			if ptr, ok := t.(*types.Pointer); ok {
+				t = ptr.Elem()
+			}
+			if embedded, ok := t.Underlying().(*types.Struct); ok {
+				p.addFields(embedded, seen)
+				continue
+			}
+		}
+		if !field.Exported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name()
+		}
+		if _, exists := p.Struct[name]; exists {
+			continue
+		}
+		fp := Param{Name: field.Name()}
+		fp.resolve(field.Type(), seen)
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				fp.Optional = true
+			case "string":
+				fp.Kind = "string"
+			}
+		}
+		p.Struct[name] = fp
+	}
+}
+
+// Schema returns a compact description of the wire format of
+// the param, e.g. {login: string, remember_me?: boolean}.
+func (p Param) Schema() string {
+	switch p.Kind {
+	case "array":
+		return "[" + p.Elem.Schema() + "]"
+	case "object":
+		if p.Elem != nil {
+			return "{string: " + p.Elem.Schema() + "}"
+		}
+		if p.Struct == nil {
+			return p.Type
+		}
+		names := []string{}
+		for name := range p.Struct {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			field := p.Struct[name]
+			if field.Optional {
+				name += "?"
+			}
+			fields[i] = name + ": " + field.Schema()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case "":
+		return p.Type
+	}
+	return p.Kind
+}
@@ -32,7 +32,7 @@ func Decode(auth string) (username string, unixtime, loginID, sessionID int64, o
 	if len(s) != 2 {
 		return
 	}
-	mac, code := s[0], s[1]
+	code, mac := s[0], s[1]
 	s = strings.SplitN(code, "|", 5)
 	if len(s) != 5 {
 		return
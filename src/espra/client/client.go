@@ -0,0 +1,116 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+// Package client provides a Go client for the services of an
+// Espra app. The typed methods in api.go, and the types that
+// they use, are generated by genapi so that the client doesn't
+// depend on any of the app's packages, e.g.
+//
+//	c := client.New("https://espra.com")
+//	token, err := c.Login(&client.LoginInfo{...})
+//	if err == nil {
+//		c.Auth = token
+//	}
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Client calls services at the Endpoint. If Auth is set, it
+// is sent as the 'auth' header field with every call.
+type Client struct {
+	Auth       string
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// Error is returned by calls which fail on the server. The
+// Code is one of the error codes defined by the rpc package,
+// e.g. "auth_expired".
+type Error struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type Header map[string]interface{}
+
+type response struct {
+	Header Header            `json:"header"`
+	Reply  []json.RawMessage `json:"reply"`
+	Error  *Error            `json:"error"`
+}
+
+func New(endpoint string) *Client {
+	return &Client{Endpoint: endpoint, HTTPClient: http.DefaultClient}
+}
+
+// Call calls the named service and decodes its replies into
+// the values pointed to by replies. Errors returned by the
+// service are of type *Error.
+func (c *Client) Call(name string, args []interface{}, replies ...interface{}) error {
+	return c.CallVersion(name, 0, args, replies...)
+}
+
+// CallVersion calls a specific version of the named service.
+// A zero version calls the oldest one.
+func (c *Client) CallVersion(name string, version int, args []interface{}, replies ...interface{}) error {
+	header := Header{}
+	if c.Auth != "" {
+		header["auth"] = c.Auth
+	}
+	if version > 0 {
+		header["version"] = version
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"header": header,
+		"call":   append([]interface{}{name}, args...),
+	})
+	if err != nil {
+		return err
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Post(c.Endpoint+"/_api", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res := &response{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("client: couldn't decode the response for %s (%s): %s", name, resp.Status, err)
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	for i, reply := range replies {
+		if i >= len(res.Reply) {
+			return fmt.Errorf("client: %s returned %d replies, expected %d", name, len(res.Reply), len(replies))
+		}
+		if err := json.Unmarshal(res.Reply[i], reply); err != nil {
+			return fmt.Errorf("client: couldn't decode reply %d for %s: %s", i, name, err)
+		}
+	}
+	return nil
+}
+
+// URL returns the URL for calling the named GET service with
+// the given args as path segments.
+func (c *Client) URL(name string, args ...interface{}) string {
+	path := "/_get/" + name
+	for _, arg := range args {
+		path += "/" + fmt.Sprint(arg)
+	}
+	return c.Endpoint + (&url.URL{Path: path}).String()
+}
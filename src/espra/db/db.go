@@ -115,7 +115,7 @@ type DomlyAttrs map[string]interface{} // string or Domly
 
 type Content struct {
 	Body       []byte   `datastore:"b,noindex"`
-	Data       []*Field `datastore:"d,noindex"`
+	Data       []*Field `datastore:"-"`
 	Head       []byte   `datastore:"h,noindex"`
 	Parents    []string `datastore:"p,noindex"`
 	RenderType []string `datastore:"r,noindex"`
@@ -0,0 +1,418 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package db
+
+import (
+	"appengine/datastore"
+	"bytes"
+	"encoding/json"
+	"espra/ident"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// These limits constrain the Field values which are accepted
+// as valid. Strings are limited to the size of indexable
+// datastore strings, whilst Text is unbounded.
+const (
+	MaxFieldDepth = 32
+	MaxStringSize = 500
+)
+
+// File references an uploaded blob.
+type File struct {
+	BlobKey string `json:"blob"`
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Type    string `json:"type"`
+}
+
+// Geo is a point specified by its latitude and longitude in
+// degrees.
+type Geo struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Unit is a quantity of a particular unit of measure, e.g.
+// {Value: 1.5, Unit: "kg"}.
+type Unit struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+var typeNames = []string{
+	NullType:   "null",
+	BoolType:   "bool",
+	DateType:   "date",
+	FileType:   "file",
+	FloatType:  "float",
+	GeoType:    "geo",
+	ListType:   "list",
+	NumberType: "number",
+	ObjectType: "object",
+	RefType:    "ref",
+	StringType: "string",
+	TextType:   "text",
+	UnitType:   "unit",
+}
+
+var typeIDs = map[string]uint8{}
+
+// TypeName returns the name used for the field type within
+// JSON, e.g. "geo" for GeoType.
+func TypeName(typ uint8) string {
+	if int(typ) < len(typeNames) {
+		return typeNames[typ]
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+// FieldError describes why a field isn't valid. The Path
+// identifies the field within nested lists and objects, e.g.
+// "address.lines[1]".
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if e.Path == "" {
+		return "db: invalid field: " + e.Message
+	}
+	return fmt.Sprintf("db: invalid field %s: %s", e.Path, e.Message)
+}
+
+func fieldError(path, format string, a ...interface{}) error {
+	return &FieldError{path, fmt.Sprintf(format, a...)}
+}
+
+func validFloat(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// Validate checks that the Value of the field is of the Go
+// type corresponding to its Type, i.e.
+//
+//	NullType    nil
+//	BoolType    bool
+//	DateType    time.Time
+//	FileType    File
+//	FloatType   float64
+//	GeoType     Geo
+//	ListType    []*Field (without keys)
+//	NumberType  int64
+//	ObjectType  []*Field (with unique keys)
+//	RefType     string (a normalised ref)
+//	StringType  string
+//	TextType    string
+//	UnitType    Unit
+func (f *Field) Validate() error {
+	return f.validate(f.Key, 0)
+}
+
+func (f *Field) validate(path string, depth int) error {
+	if depth > MaxFieldDepth {
+		return fieldError(path, "exceeds the maximum depth of %d", MaxFieldDepth)
+	}
+	ok := true
+	switch f.Type {
+	case NullType:
+		ok = f.Value == nil
+	case BoolType:
+		_, ok = f.Value.(bool)
+	case DateType:
+		_, ok = f.Value.(time.Time)
+	case FileType:
+		var file File
+		if file, ok = f.Value.(File); ok && (file.BlobKey == "" || file.Size < 0) {
+			return fieldError(path, "files need a blob key and a non-negative size")
+		}
+	case FloatType:
+		var v float64
+		if v, ok = f.Value.(float64); ok && !validFloat(v) {
+			return fieldError(path, "floats need to be finite")
+		}
+	case GeoType:
+		var geo Geo
+		if geo, ok = f.Value.(Geo); ok && !(geo.Lat >= -90 && geo.Lat <= 90 && geo.Lng >= -180 && geo.Lng <= 180) {
+			return fieldError(path, "geo point out of range: %v, %v", geo.Lat, geo.Lng)
+		}
+	case ListType:
+		var list []*Field
+		if list, ok = f.Value.([]*Field); ok {
+			for i, elem := range list {
+				elemPath := fmt.Sprintf("%s[%d]", path, i)
+				if elem == nil {
+					return fieldError(elemPath, "nil list element")
+				}
+				if elem.Key != "" {
+					return fieldError(elemPath, "list elements can't have keys")
+				}
+				if err := elem.validate(elemPath, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	case NumberType:
+		_, ok = f.Value.(int64)
+	case ObjectType:
+		var fields []*Field
+		if fields, ok = f.Value.([]*Field); ok {
+			seen := map[string]bool{}
+			for _, field := range fields {
+				if field == nil || field.Key == "" {
+					return fieldError(path, "object fields need keys")
+				}
+				fieldPath := field.Key
+				if path != "" {
+					fieldPath = path + "." + field.Key
+				}
+				if seen[field.Key] {
+					return fieldError(fieldPath, "duplicate key")
+				}
+				seen[field.Key] = true
+				if err := field.validate(fieldPath, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	case RefType:
+		var ref string
+		if ref, ok = f.Value.(string); ok {
+			if normalised, valid := ident.Ref(ref); !valid || normalised != ref {
+				return fieldError(path, "invalid ref: %q", ref)
+			}
+		}
+	case StringType, TextType:
+		var s string
+		if s, ok = f.Value.(string); ok {
+			if !utf8.ValidString(s) {
+				return fieldError(path, "strings need to be valid UTF-8")
+			}
+			if f.Type == StringType && len(s) > MaxStringSize {
+				return fieldError(path, "strings can't be longer than %d bytes, use text instead", MaxStringSize)
+			}
+		}
+	case UnitType:
+		var unit Unit
+		if unit, ok = f.Value.(Unit); ok && (unit.Unit == "" || !validFloat(unit.Value)) {
+			return fieldError(path, "units need a unit of measure and a finite value")
+		}
+	default:
+		return fieldError(path, "unknown type %d", f.Type)
+	}
+	if !ok {
+		return fieldError(path, "expected a %s value, got %T", TypeName(f.Type), f.Value)
+	}
+	return nil
+}
+
+type jsonField struct {
+	Key   string          `json:"key,omitempty"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MarshalJSON encodes the field as an object with its key,
+// type name and value. Dates are encoded as RFC 3339 strings,
+// and lists and objects as arrays of their fields.
+func (f *Field) MarshalJSON() ([]byte, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(f.toJSON())
+}
+
+func (f *Field) toJSON() *jsonField {
+	var value interface{}
+	switch f.Type {
+	case NullType:
+	case DateType:
+		value = f.Value.(time.Time).UTC().Format(time.RFC3339Nano)
+	case ListType, ObjectType:
+		fields := f.Value.([]*Field)
+		list := make([]*jsonField, len(fields))
+		for i, field := range fields {
+			list[i] = field.toJSON()
+		}
+		value = list
+	default:
+		value = f.Value
+	}
+	enc := json.RawMessage(nil)
+	if value != nil {
+		enc, _ = json.Marshal(value)
+	}
+	return &jsonField{f.Key, TypeName(f.Type), enc}
+}
+
+// UnmarshalJSON decodes the field from the format produced by
+// MarshalJSON and validates it.
+func (f *Field) UnmarshalJSON(data []byte) error {
+	raw := &jsonField{}
+	if err := json.Unmarshal(data, raw); err != nil {
+		return err
+	}
+	if err := f.fromJSON(raw, raw.Key, 0); err != nil {
+		return err
+	}
+	return f.Validate()
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// fromJSON decodes the field, with errors reported for the
+// given path in the same form as Validate.
+func (f *Field) fromJSON(raw *jsonField, path string, depth int) error {
+	if depth > MaxFieldDepth {
+		return fieldError(path, "exceeds the maximum depth of %d", MaxFieldDepth)
+	}
+	typ, exists := typeIDs[raw.Type]
+	if !exists {
+		return fieldError(path, "unknown type %q", raw.Type)
+	}
+	f.Key, f.Type, f.Value = raw.Key, typ, nil
+	if typ == NullType {
+		return nil
+	}
+	if len(raw.Value) == 0 {
+		return fieldError(path, "missing value")
+	}
+	var err error
+	switch typ {
+	case BoolType:
+		var v bool
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	case DateType:
+		var s string
+		if err = json.Unmarshal(raw.Value, &s); err == nil {
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, s)
+			f.Value = t.UTC()
+		}
+	case FileType:
+		var v File
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	case FloatType:
+		var v float64
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	case GeoType:
+		var v Geo
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	case ListType, ObjectType:
+		list := []*jsonField{}
+		if err = json.Unmarshal(raw.Value, &list); err == nil {
+			fields := make([]*Field, len(list))
+			for i, elem := range list {
+				elemPath := fmt.Sprintf("%s[%d]", path, i)
+				if elem == nil {
+					return fieldError(elemPath, "null field")
+				}
+				if typ == ObjectType {
+					elemPath = elem.Key
+					if path != "" {
+						elemPath = path + "." + elem.Key
+					}
+				}
+				fields[i] = &Field{}
+				if err = fields[i].fromJSON(elem, elemPath, depth+1); err != nil {
+					return err
+				}
+			}
+			f.Value = fields
+		}
+	case NumberType:
+		var v json.Number
+		if err = decodeJSON(raw.Value, &v); err == nil {
+			var n int64
+			n, err = v.Int64()
+			f.Value = n
+		}
+	case RefType, StringType, TextType:
+		var v string
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	case UnitType:
+		var v Unit
+		err = json.Unmarshal(raw.Value, &v)
+		f.Value = v
+	}
+	if err != nil {
+		return fieldError(path, "invalid %s value: %s", raw.Type, err)
+	}
+	return nil
+}
+
+// Load implements datastore.PropertyLoadSaver so that the Data
+// fields, which the datastore can't store natively, are loaded
+// from their JSON encoding.
+func (c *Content) Load(props <-chan datastore.Property) error {
+	*c = Content{}
+	fields := make(chan datastore.Property)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- datastore.LoadStruct(c, fields)
+	}()
+	var data []byte
+	for p := range props {
+		if p.Name == "d" {
+			data, _ = p.Value.([]byte)
+			continue
+		}
+		select {
+		case fields <- p:
+		case err := <-errc:
+			// LoadStruct only stops reading early if it fails.
+			return err
+		}
+	}
+	close(fields)
+	if err := <-errc; err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, &c.Data)
+}
+
+// Save implements datastore.PropertyLoadSaver so that the Data
+// fields are stored as a single unindexed JSON property.
+func (c *Content) Save(props chan<- datastore.Property) error {
+	defer close(props)
+	data, err := json.Marshal(c.Data)
+	if err != nil {
+		return err
+	}
+	fields := make(chan datastore.Property)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- datastore.SaveStruct(c, fields)
+	}()
+	for p := range fields {
+		props <- p
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	props <- datastore.Property{Name: "d", Value: data, NoIndex: true}
+	return nil
+}
+
+func init() {
+	for id, name := range typeNames {
+		typeIDs[name] = uint8(id)
+	}
+}
@@ -0,0 +1,110 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package db
+
+import (
+	"appengine/datastore"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFields() []*Field {
+	return []*Field{
+		{Key: "title", Type: StringType, Value: "Hello"},
+		{Key: "body", Type: TextType, Value: strings.Repeat("x", 1000)},
+		{Key: "published", Type: DateType, Value: time.Date(2013, 6, 1, 12, 30, 0, 5, time.UTC)},
+		{Key: "draft", Type: BoolType, Value: false},
+		{Key: "views", Type: NumberType, Value: int64(1) << 60},
+		{Key: "score", Type: FloatType, Value: 4.5},
+		{Key: "author", Type: RefType, Value: "+tav"},
+		{Key: "cover", Type: FileType, Value: File{BlobKey: "abc", Name: "cover.png", Size: 1024, Type: "image/png"}},
+		{Key: "weight", Type: UnitType, Value: Unit{Unit: "kg", Value: 1.5}},
+		{Key: "nothing", Type: NullType},
+		{Key: "venue", Type: ObjectType, Value: []*Field{
+			{Key: "location", Type: GeoType, Value: Geo{Lat: 51.5, Lng: -0.12}},
+			{Key: "tags", Type: ListType, Value: []*Field{
+				{Type: StringType, Value: "london"},
+				{Type: RefType, Value: "#espra"},
+			}},
+		}},
+	}
+}
+
+func TestFieldJSON(t *testing.T) {
+	fields := testFields()
+	enc, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("couldn't encode the fields: %s", err)
+	}
+	decoded := []*Field{}
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatalf("couldn't decode the fields: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, fields) {
+		t.Errorf("the fields didn't round-trip through JSON:\n%s", enc)
+	}
+	nested := `{"type": "object", "value": [{"key": "a", "type": "list", "value": [{"type": "number", "value": 1.5}]}]}`
+	err = json.Unmarshal([]byte(nested), &Field{})
+	if ferr, ok := err.(*FieldError); !ok || ferr.Path != "a[0]" {
+		t.Errorf("expected a decoding error for the path a[0], got %v", err)
+	}
+}
+
+func TestFieldValidate(t *testing.T) {
+	for _, field := range testFields() {
+		if err := field.Validate(); err != nil {
+			t.Errorf("unexpected error for %s: %s", field.Key, err)
+		}
+	}
+	invalid := []*Field{
+		{Type: BoolType, Value: "true"},
+		{Type: FloatType, Value: math.NaN()},
+		{Type: GeoType, Value: Geo{Lat: 91}},
+		{Type: ListType, Value: []*Field{{Key: "a", Type: NullType}}},
+		{Type: NumberType, Value: 1},
+		{Type: ObjectType, Value: []*Field{{Key: "a", Type: NullType}, {Key: "a", Type: NullType}}},
+		{Type: RefType, Value: "tav"},
+		{Type: StringType, Value: strings.Repeat("x", MaxStringSize+1)},
+		{Type: UnitType, Value: Unit{Value: 1}},
+		{Type: 99},
+	}
+	for _, field := range invalid {
+		if err := field.Validate(); err == nil {
+			t.Errorf("expected an error for %s value %#v", TypeName(field.Type), field.Value)
+		}
+	}
+	nested := &Field{Type: ObjectType, Value: []*Field{
+		{Key: "a", Type: ListType, Value: []*Field{{Type: NumberType, Value: 1.5}}},
+	}}
+	err := nested.Validate()
+	if ferr, ok := err.(*FieldError); !ok || ferr.Path != "a[0]" {
+		t.Errorf("expected an error for the path a[0], got %v", err)
+	}
+}
+
+func TestContentDatastore(t *testing.T) {
+	content := &Content{
+		Body:       []byte("body"),
+		Data:       testFields(),
+		Head:       []byte("head"),
+		Parents:    []string{"p1", "p2"},
+		RenderType: []string{"markdown"},
+		Version:    3,
+	}
+	props := make(chan datastore.Property, 32)
+	if err := content.Save(props); err != nil {
+		t.Fatalf("couldn't save the content: %s", err)
+	}
+	loaded := &Content{}
+	if err := loaded.Load(props); err != nil {
+		t.Fatalf("couldn't load the content: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, content) {
+		t.Errorf("the content didn't round-trip through the datastore: %#v", loaded)
+	}
+}
@@ -0,0 +1,106 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+// Package gae implements the rpc.Backend interface on top of
+// the App Engine datastore and logging APIs.
+package gae
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"espra/rpc"
+	"net/http"
+	"time"
+)
+
+type Backend struct {
+	appengine.Context
+}
+
+func NewBackend(r *http.Request) rpc.Backend {
+	return &Backend{appengine.NewContext(r)}
+}
+
+func (b *Backend) key(k *rpc.Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	return datastore.NewKey(b.Context, k.Kind(), k.StringID(), k.IntID(), b.key(k.Parent()))
+}
+
+func fromKey(k *datastore.Key) *rpc.Key {
+	if k == nil {
+		return nil
+	}
+	return rpc.NewKey(k.Kind(), k.StringID(), k.IntID(), fromKey(k.Parent()))
+}
+
+func convertError(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return rpc.ErrNoSuchEntity
+	}
+	return err
+}
+
+func (b *Backend) Delete(key *rpc.Key) error {
+	return datastore.Delete(b.Context, b.key(key))
+}
+
+func (b *Backend) Get(key *rpc.Key, dst interface{}) error {
+	return convertError(datastore.Get(b.Context, b.key(key), dst))
+}
+
+func (b *Backend) GetAll(q *rpc.Query, dst interface{}) ([]*rpc.Key, error) {
+	query := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		query = query.Ancestor(b.key(q.Ancestor))
+	}
+	for _, f := range q.Filters {
+		value := f.Value
+		if key, ok := value.(*rpc.Key); ok {
+			value = b.key(key)
+		}
+		query = query.Filter(f.Property+" "+f.Op, value)
+	}
+	for _, order := range q.Orders {
+		query = query.Order(order)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		query = query.Offset(q.Offset)
+	}
+	if q.KeysOnly {
+		query = query.KeysOnly()
+	}
+	keys, err := query.GetAll(b.Context, dst)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	results := make([]*rpc.Key, len(keys))
+	for i, key := range keys {
+		results[i] = fromKey(key)
+	}
+	return results, nil
+}
+
+func (b *Backend) Put(key *rpc.Key, src interface{}) (*rpc.Key, error) {
+	k, err := datastore.Put(b.Context, b.key(key), src)
+	if err != nil {
+		return nil, err
+	}
+	return fromKey(k), nil
+}
+
+func (b *Backend) RunInTransaction(f func(tx rpc.Backend) error) error {
+	return datastore.RunInTransaction(b.Context, func(tc appengine.Context) error {
+		return f(&Backend{tc})
+	}, nil)
+}
+
+// WithDeadline uses appengine.Timeout so that the API calls
+// made via the returned Backend are cancelled at the deadline.
+func (b *Backend) WithDeadline(deadline time.Time) rpc.Backend {
+	return &Backend{appengine.Timeout(b.Context, deadline.Sub(time.Now()))}
+}
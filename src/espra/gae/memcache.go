@@ -0,0 +1,112 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package gae
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"encoding/json"
+	"errors"
+	"espra/rpc"
+	"fmt"
+	"time"
+)
+
+var errNoContext = errors.New("gae: the rpc context doesn't have an App Engine backend")
+
+func appContext(ctx *rpc.Context) (appengine.Context, error) {
+	if b, ok := ctx.Backend.(*Backend); ok {
+		return b.Context, nil
+	}
+	return nil, errNoContext
+}
+
+// IdempotencyStore implements rpc.IdempotencyStore using
+// memcache. Keys which are in progress are stored with an
+// empty value, which expires at the end of the lease unless
+// it's replaced by the saved reply.
+type IdempotencyStore struct{}
+
+func (IdempotencyStore) Reserve(ctx *rpc.Context, key string, lease time.Duration) (*rpc.IdempotentReply, error) {
+	c, err := appContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = memcache.Add(c, &memcache.Item{Key: key, Value: []byte{}, Expiration: lease})
+	if err == nil {
+		return nil, nil
+	}
+	if err != memcache.ErrNotStored {
+		return nil, err
+	}
+	item, err := memcache.Get(c, key)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, rpc.ErrInProgress
+		}
+		return nil, err
+	}
+	if len(item.Value) == 0 {
+		return nil, rpc.ErrInProgress
+	}
+	reply := &rpc.IdempotentReply{}
+	if err = json.Unmarshal(item.Value, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (IdempotencyStore) Save(ctx *rpc.Context, key string, reply *rpc.IdempotentReply, window time.Duration) error {
+	c, err := appContext(ctx)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return memcache.Set(c, &memcache.Item{Key: key, Value: value, Expiration: window})
+}
+
+func (IdempotencyStore) Release(ctx *rpc.Context, key string) error {
+	c, err := appContext(ctx)
+	if err != nil {
+		return err
+	}
+	err = memcache.Delete(c, key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// RateLimitStore implements rpc.RateLimitStore using memcache
+// so that limits are shared across instances. As memcache can
+// only update counters atomically, calls are counted within
+// fixed windows of the limit's period instead of using token
+// buckets, with up to Burst calls allowed per window.
+type RateLimitStore struct{}
+
+func (RateLimitStore) Take(ctx *rpc.Context, key string, limit *rpc.Limit) (time.Duration, error) {
+	c, err := appContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	window := now.UnixNano() / int64(limit.Per)
+	reset := time.Unix(0, (window+1)*int64(limit.Per)).Sub(now)
+	key = fmt.Sprintf("%s:%d", key, window)
+	err = memcache.Add(c, &memcache.Item{Key: key, Value: []byte("0"), Expiration: reset + time.Minute})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	n, err := memcache.Increment(c, key, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(limit.Burst) {
+		return reset, nil
+	}
+	return 0, nil
+}
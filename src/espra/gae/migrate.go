@@ -0,0 +1,123 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package gae
+
+import (
+	"appengine"
+	"appengine/delay"
+	"encoding/json"
+	"errors"
+	"espra/kind"
+	"espra/rpc"
+	"net/http"
+)
+
+// BackfillBatch specifies the number of entities that are
+// migrated by each backfill task.
+var BackfillBatch = 100
+
+var backfill *delay.Function
+
+// backfillBatch migrates a batch of entities of the given kind
+// and then queues itself until they have all been migrated.
+// The progress is saved after each batch so that it can be
+// viewed via HandleBackfill.
+func backfillBatch(c appengine.Context, entityKind string) error {
+	ctx := rpc.NewContext(&Backend{c}, "", nil)
+	key := ctx.StrKey(kind.Backfill, entityKind, nil)
+	p := &rpc.BackfillProgress{}
+	if err := ctx.Get(key, p); err != nil && err != rpc.ErrNoSuchEntity {
+		return err
+	}
+	if p.Done {
+		return nil
+	}
+	p.Kind = entityKind
+	berr := ctx.Backfill(p, BackfillBatch)
+	if _, err := ctx.Put(key, p); err != nil {
+		return err
+	}
+	if berr != nil {
+		c.Errorf("gae: stopped the backfill of %s: %s", entityKind, berr)
+		return nil
+	}
+	if !p.Done {
+		backfill.Call(c, entityKind)
+	}
+	return nil
+}
+
+// ErrBackfillRunning is returned by StartBackfill if the kind
+// is already being backfilled.
+var ErrBackfillRunning = errors.New("gae: the backfill is already running")
+
+// StartBackfill queues the task to migrate all the entities of
+// the kind. Backfills which were stopped by an error are
+// resumed from where they left off, while those which are
+// still running are left alone and ErrBackfillRunning is
+// returned.
+func StartBackfill(c appengine.Context, entityKind string) error {
+	ctx := rpc.NewContext(&Backend{c}, "", nil)
+	key := ctx.StrKey(kind.Backfill, entityKind, nil)
+	return ctx.RunInTransaction(func(ctx *rpc.Context) error {
+		p := &rpc.BackfillProgress{}
+		err := ctx.Get(key, p)
+		switch {
+		case err == rpc.ErrNoSuchEntity || (err == nil && p.Done):
+			p = &rpc.BackfillProgress{Kind: entityKind}
+		case err != nil:
+			return err
+		case p.Error == "":
+			return ErrBackfillRunning
+		default:
+			p.Error = ""
+		}
+		if _, err := ctx.Put(key, p); err != nil {
+			return err
+		}
+		// Queue the task within the transaction so that it only
+		// runs if the progress is saved.
+		backfill.Call(ctx.Backend.(*Backend).Context, entityKind)
+		return nil
+	})
+}
+
+// HandleBackfill starts the backfill of the kind specified by
+// the 'kind' parameter of POST requests, and otherwise writes
+// the progress of all backfills as JSON.
+func HandleBackfill(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		entityKind := r.FormValue("kind")
+		if entityKind == "" {
+			http.Error(w, "Missing kind parameter", http.StatusBadRequest)
+			return
+		}
+		if err := StartBackfill(c, entityKind); err != nil {
+			status := http.StatusInternalServerError
+			if err == ErrBackfillRunning {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	ctx := rpc.NewContext(&Backend{c}, "", nil)
+	progress := []*rpc.BackfillProgress{}
+	if _, err := ctx.GetAll(rpc.NewQuery(kind.Backfill), &progress); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(progress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func init() {
+	backfill = delay.Func("backfill", backfillBatch)
+}
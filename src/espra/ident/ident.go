@@ -63,7 +63,7 @@ func UserRef(ident string) (string, bool) {
 }
 
 func Ref(ident string) (string, bool) {
-	if ident[0] != '#' || ident[0] != '+' {
+	if ident == "" || (ident[0] != '#' && ident[0] != '+') {
 		return "", false
 	}
 	return normalise(ident, true)
@@ -4,48 +4,37 @@
 package item
 
 import (
-	"appengine/datastore"
 	"espra/db"
 	"espra/ident"
 	"espra/rpc"
 	"espra/ui"
-	"fmt"
 )
 
 type CreateRequest struct {
-	By      string
+	By      string `validate:"required,username"`
 	Head    string
-	Space   string
-	Parents []string
+	Space   string   `validate:"required,ref"`
+	Parents []string `validate:"ref"`
 }
 
+// item.create(scopes=items:write, idempotent=24h, ratelimit=60/1m)
+// Create posts a new item to a space.
 func Create(ctx *rpc.Context, req *CreateRequest) error {
 
 	item := &db.Item{}
 	terms := []string{}
 
-	var ok bool
-
-	if item.Space, ok = ident.Ref(req.Space); !ok {
-		return fmt.Errorf("invalid user/space identifier in the 'space' field: %s", req.Space)
-	}
-
+	// The request has already been validated, so the
+	// identifiers only need to be normalised here.
+	item.Space, _ = ident.Ref(req.Space)
 	terms = append(terms, db.SpaceTerm+item.Space)
 
-	if item.By, ok = ident.Username(req.By); !ok {
-		return fmt.Errorf("invalid username in the 'by' field: %s", req.By)
-	}
-
+	item.By, _ = ident.Username(req.By)
 	terms = append(terms, db.ByTerm+item.By[1:])
 
 	index := &db.Index{}
 	item.Domly, index.Terms, item.SlashTag, _ = ui.parseMsg(req.Head, terms)
-	_ = datastore.Delete
 
 	return nil
 
 }
-
-func init() {
-	rpc.Register("item.create", Create)
-}
@@ -9,8 +9,10 @@ const (
 	AccessToken     = "AT"
 	Account         = "A"
 	AccountLogin    = "AL"
+	Backfill        = "BF"
 	ClientLog       = "CL"
 	ClientToken     = "CT"
+	Content         = "C"
 	EmailAccount    = "EA"
 	GithubAccount   = "GA"
 	Index           = "N"
@@ -5,18 +5,22 @@ package espra
 
 import (
 	"appengine"
+	"appengine/user"
 	"espra/backend"
 	"espra/config"
+	"espra/gae"
 	"espra/rpc"
 	"net/http"
 	"strings"
 )
 
 var (
-	devServer    bool
-	html404      = []byte(htmlErr404Str)
-	htmlHome     = []byte(htmlHomeStr)
-	htmlRedirect = []byte(htmlRedirectStr)
+	apiDocHTML     = []byte(apiDocHTMLStr)
+	apiDocMarkdown = []byte(apiDocMarkdownStr)
+	devServer      bool
+	html404        = []byte(htmlErr404Str)
+	htmlHome       = []byte(htmlHomeStr)
+	htmlRedirect   = []byte(htmlRedirectStr)
 )
 
 func handle(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +47,26 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			switch path {
 			case "/_api":
 				rpc.Handle(w, r)
+			case "/_docs":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				render(apiDocHTML, w)
+			case "/_docs.md":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Write(apiDocMarkdown)
+			case "/_jsonrpc":
+				rpc.HandleJSONRPC(w, r)
+			case "/_migrate":
+				if user.IsAdmin(appengine.NewContext(r)) {
+					gae.HandleBackfill(w, r)
+				} else {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+				}
+			case "/_stats":
+				if user.IsAdmin(appengine.NewContext(r)) {
+					rpc.HandleStats(w, r)
+				} else {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+				}
 			case "/_ah/start":
 				backend.Start(w, r)
 			case "/_ah/stop":
@@ -89,5 +113,8 @@ func init() {
 	if appengine.IsDevAppServer() {
 		devServer = true
 	}
+	rpc.SetBackend(gae.NewBackend)
+	rpc.SetIdempotencyStore(gae.IdempotencyStore{})
+	rpc.SetRateLimitStore(gae.RateLimitStore{})
 	http.DefaultServeMux.Handle("/", http.HandlerFunc(handle))
 }
@@ -0,0 +1,366 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package msgpack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Unmarshal decodes the MessagePack value in data into the
+// value pointed to by v. As with encoding/json, numbers are
+// decoded as float64 values when v holds an interface{}, but
+// binary values are decoded as []byte.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := &decoder{data: data}
+	if err := d.decode(rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return ErrTrailing
+	}
+	return nil
+}
+
+func typeError(t token, typ reflect.Type) error {
+	return fmt.Errorf("msgpack: cannot decode %s into a value of type %s", t, typ)
+}
+
+func (d *decoder) decode(rv reflect.Value, depth int) error {
+	if depth > MaxDepth {
+		return ErrMaxDepth
+	}
+	if d.pos < len(d.data) && d.data[d.pos] == 0xc0 {
+		d.pos++
+		switch rv.Kind() {
+		case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	}
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		if rv.Type().Implements(jsonUnmarshalerType) {
+			return d.decodeJSON(rv.Interface().(json.Unmarshaler))
+		}
+		rv = rv.Elem()
+	}
+	if rv.Type() == rawMessageType {
+		start := d.pos
+		if err := d.skip(depth); err != nil {
+			return err
+		}
+		rv.SetBytes(append(RawMessage(nil), d.data[start:d.pos]...))
+		return nil
+	}
+	if rv.CanAddr() && reflect.PtrTo(rv.Type()).Implements(jsonUnmarshalerType) {
+		return d.decodeJSON(rv.Addr().Interface().(json.Unmarshaler))
+	}
+	t, err := d.token()
+	if err != nil {
+		return err
+	}
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return typeError(t, rv.Type())
+		}
+		v, err := d.generic(t, depth)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+	case reflect.Bool:
+		if t.kind != boolToken {
+			return typeError(t, rv.Type())
+		}
+		rv.SetBool(t.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := t.int64()
+		if !ok || rv.OverflowInt(n) {
+			return typeError(t, rv.Type())
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := t.uint64()
+		if !ok || rv.OverflowUint(n) {
+			return typeError(t, rv.Type())
+		}
+		rv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, ok := t.float64()
+		if !ok || rv.OverflowFloat(f) {
+			return typeError(t, rv.Type())
+		}
+		rv.SetFloat(f)
+	case reflect.String:
+		if t.kind != strToken && t.kind != binToken {
+			return typeError(t, rv.Type())
+		}
+		rv.SetString(string(t.data))
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 && (t.kind == binToken || t.kind == strToken) {
+			rv.SetBytes(append([]byte{}, t.data...))
+			return nil
+		}
+		if t.kind != arrayToken {
+			return typeError(t, rv.Type())
+		}
+		slice := reflect.MakeSlice(rv.Type(), t.n, t.n)
+		for i := 0; i < t.n; i++ {
+			if err := d.decode(slice.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.Array:
+		if t.kind != arrayToken {
+			return typeError(t, rv.Type())
+		}
+		for i := 0; i < t.n; i++ {
+			if i >= rv.Len() {
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(rv.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		for i := t.n; i < rv.Len(); i++ {
+			rv.Index(i).Set(reflect.Zero(rv.Type().Elem()))
+		}
+	case reflect.Map:
+		if t.kind != mapToken {
+			return typeError(t, rv.Type())
+		}
+		return d.decodeMap(rv, t.n, depth)
+	case reflect.Struct:
+		if t.kind != mapToken {
+			return typeError(t, rv.Type())
+		}
+		return d.decodeStruct(rv, t.n, depth)
+	default:
+		return typeError(t, rv.Type())
+	}
+	return nil
+}
+
+// decodeJSON decodes the value via its JSON encoding.
+func (d *decoder) decodeJSON(u json.Unmarshaler) error {
+	start := d.pos
+	if err := d.skip(0); err != nil {
+		return err
+	}
+	data, err := ToJSON(d.data[start:d.pos])
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalJSON(data)
+}
+
+func (d *decoder) decodeMap(rv reflect.Value, n, depth int) error {
+	if depth >= MaxDepth {
+		return ErrMaxDepth
+	}
+	typ := rv.Type()
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(typ))
+	}
+	for i := 0; i < n; i++ {
+		name, err := d.key()
+		if err != nil {
+			return err
+		}
+		key := reflect.New(typ.Key()).Elem()
+		switch key.Kind() {
+		case reflect.String:
+			key.SetString(name)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			k, err := strconv.ParseInt(name, 10, 64)
+			if err != nil || key.OverflowInt(k) {
+				return fmt.Errorf("msgpack: invalid map key for %s: %q", typ, name)
+			}
+			key.SetInt(k)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			k, err := strconv.ParseUint(name, 10, 64)
+			if err != nil || key.OverflowUint(k) {
+				return fmt.Errorf("msgpack: invalid map key for %s: %q", typ, name)
+			}
+			key.SetUint(k)
+		default:
+			return fmt.Errorf("msgpack: unsupported map key type: %s", typ.Key())
+		}
+		value := reflect.New(typ.Elem()).Elem()
+		if err := d.decode(value, depth+1); err != nil {
+			return err
+		}
+		rv.SetMapIndex(key, value)
+	}
+	return nil
+}
+
+// decodeStruct decodes the map into the struct's fields. As
+// with encoding/json, keys are matched to field names case
+// insensitively if there's no exact match, and unknown keys
+// are ignored.
+func (d *decoder) decodeStruct(rv reflect.Value, n, depth int) error {
+	if depth >= MaxDepth {
+		return ErrMaxDepth
+	}
+	fields := cachedFields(rv.Type())
+	for i := 0; i < n; i++ {
+		name, err := d.key()
+		if err != nil {
+			return err
+		}
+		var match *field
+		for _, f := range fields {
+			if f.name == name {
+				match = f
+				break
+			}
+			if match == nil && strings.EqualFold(f.name, name) {
+				match = f
+			}
+		}
+		if match == nil {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		fv, _ := fieldByIndex(rv, match.index, true)
+		if err := d.decode(fv, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generic returns the value of the token in the same form as
+// encoding/json does when decoding into an interface{}.
+func (d *decoder) generic(t token, depth int) (interface{}, error) {
+	switch t.kind {
+	case nilToken:
+		return nil, nil
+	case boolToken:
+		return t.b, nil
+	case intToken, uintToken, floatToken:
+		f, _ := t.float64()
+		return f, nil
+	case strToken:
+		return string(t.data), nil
+	case binToken:
+		return append([]byte{}, t.data...), nil
+	case arrayToken:
+		if depth >= MaxDepth {
+			return nil, ErrMaxDepth
+		}
+		list := make([]interface{}, t.n)
+		for i := range list {
+			if err := d.decode(reflect.ValueOf(&list[i]).Elem(), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	if depth >= MaxDepth {
+		return nil, ErrMaxDepth
+	}
+	obj := make(map[string]interface{}, t.n)
+	for i := 0; i < t.n; i++ {
+		key, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := d.decode(reflect.ValueOf(&v).Elem(), depth+1); err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+	return obj, nil
+}
+
+// skip moves past the next value.
+func (d *decoder) skip(depth int) error {
+	if depth > MaxDepth {
+		return ErrMaxDepth
+	}
+	t, err := d.token()
+	if err != nil {
+		return err
+	}
+	n := t.n
+	if t.kind == mapToken {
+		n *= 2
+	} else if t.kind != arrayToken {
+		return nil
+	}
+	if depth >= MaxDepth {
+		return ErrMaxDepth
+	}
+	for i := 0; i < n; i++ {
+		if err := d.skip(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t token) int64() (int64, bool) {
+	switch t.kind {
+	case intToken:
+		return t.i, true
+	case uintToken:
+		return int64(t.u), t.u <= math.MaxInt64
+	case floatToken:
+		n := int64(t.f)
+		return n, float64(n) == t.f
+	}
+	return 0, false
+}
+
+func (t token) uint64() (uint64, bool) {
+	switch t.kind {
+	case intToken:
+		return uint64(t.i), t.i >= 0
+	case uintToken:
+		return t.u, true
+	case floatToken:
+		n := uint64(t.f)
+		return n, t.f >= 0 && float64(n) == t.f
+	}
+	return 0, false
+}
+
+func (t token) float64() (float64, bool) {
+	switch t.kind {
+	case intToken:
+		return float64(t.i), true
+	case uintToken:
+		return float64(t.u), true
+	case floatToken:
+		return t.f, true
+	}
+	return 0, false
+}
@@ -0,0 +1,403 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw encoded MessagePack value. It can be
+// used to delay decoding, or to encode precomputed values.
+type RawMessage []byte
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	numberType          = reflect.TypeOf(json.Number(""))
+	rawMessageType      = reflect.TypeOf(RawMessage(nil))
+)
+
+// Marshal returns the MessagePack encoding of v. Map keys are
+// sorted so that the output is deterministic.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encode(buf, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeLen(buf *bytes.Buffer, n int, fix, fixMax byte, b8, b16, b32 byte) {
+	switch {
+	case n <= int(fixMax):
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		buf.WriteByte(byte(n))
+	case n >= -32 && n < 0:
+		buf.WriteByte(byte(n))
+	case n > 0:
+		encodeUint(buf, uint64(n))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n <= 127:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeFloat(buf *bytes.Buffer, f float64) error {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("msgpack: unsupported float value: %v", f)
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	return nil
+}
+
+func encodeNumber(buf *bytes.Buffer, v json.Number) error {
+	if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+		encodeInt(buf, n)
+		return nil
+	}
+	if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+		encodeUint(buf, n)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil {
+		return err
+	}
+	return encodeFloat(buf, f)
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	writeLen(buf, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	buf.WriteString(s)
+}
+
+func encodeBinary(buf *bytes.Buffer, b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// encodeJSON encodes the value from its JSON encoding.
+func encodeJSON(buf *bytes.Buffer, m json.Marshaler) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	v, err := decodeJSON(data)
+	if err != nil {
+		return err
+	}
+	return encode(buf, reflect.ValueOf(v), 0)
+}
+
+func isNil(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func encode(buf *bytes.Buffer, rv reflect.Value, depth int) error {
+	if depth > MaxDepth {
+		return ErrMaxDepth
+	}
+	if !rv.IsValid() || isNil(rv) {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	typ := rv.Type()
+	switch {
+	case typ == numberType:
+		return encodeNumber(buf, json.Number(rv.String()))
+	case typ == rawMessageType:
+		buf.Write(rv.Bytes())
+		return nil
+	case typ.Implements(jsonMarshalerType):
+		return encodeJSON(buf, rv.Interface().(json.Marshaler))
+	case rv.CanAddr() && reflect.PtrTo(typ).Implements(jsonMarshalerType):
+		return encodeJSON(buf, rv.Addr().Interface().(json.Marshaler))
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeUint(buf, rv.Uint())
+	case reflect.Float32:
+		f := rv.Float()
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("msgpack: unsupported float value: %v", f)
+		}
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(f)))
+	case reflect.Float64:
+		return encodeFloat(buf, rv.Float())
+	case reflect.String:
+		encodeString(buf, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+			encodeBinary(buf, rv.Bytes())
+			return nil
+		}
+		writeLen(buf, rv.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+		for i := 0; i < rv.Len(); i++ {
+			if err := encode(buf, rv.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return encodeMap(buf, rv, depth)
+	case reflect.Struct:
+		return encodeStruct(buf, rv, depth)
+	case reflect.Interface, reflect.Ptr:
+		return encode(buf, rv.Elem(), depth+1)
+	default:
+		return fmt.Errorf("msgpack: unsupported type: %s", typ)
+	}
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, rv reflect.Value, depth int) error {
+	keys := rv.MapKeys()
+	names := make([]string, len(keys))
+	values := make(map[string]reflect.Value, len(keys))
+	for i, key := range keys {
+		switch key.Kind() {
+		case reflect.String:
+			names[i] = key.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			names[i] = strconv.FormatInt(key.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			names[i] = strconv.FormatUint(key.Uint(), 10)
+		default:
+			return fmt.Errorf("msgpack: unsupported map key type: %s", key.Type())
+		}
+		values[names[i]] = rv.MapIndex(key)
+	}
+	sort.Strings(names)
+	writeLen(buf, len(names), 0x80, 15, 0, 0xde, 0xdf)
+	for _, name := range names {
+		encodeString(buf, name)
+		if err := encode(buf, values[name], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStruct(buf *bytes.Buffer, rv reflect.Value, depth int) error {
+	fields := cachedFields(rv.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	present := make([]*field, 0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(rv, f.index, false)
+		if !ok || (f.omitEmpty && isEmpty(fv)) {
+			continue
+		}
+		values = append(values, fv)
+		present = append(present, f)
+	}
+	writeLen(buf, len(present), 0x80, 15, 0, 0xde, 0xdf)
+	for i, f := range present {
+		encodeString(buf, f.name)
+		if err := encode(buf, values[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEmpty(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// field describes a struct field as named by its json tag.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var (
+	fieldCache = map[reflect.Type][]*field{}
+	fieldMutex sync.RWMutex
+)
+
+func cachedFields(typ reflect.Type) []*field {
+	fieldMutex.RLock()
+	fields, exists := fieldCache[typ]
+	fieldMutex.RUnlock()
+	if exists {
+		return fields
+	}
+	fields = typeFields(typ)
+	fieldMutex.Lock()
+	fieldCache[typ] = fields
+	fieldMutex.Unlock()
+	return fields
+}
+
+// typeFields returns the fields of the struct type, including
+// those promoted from embedded structs without json tags. As
+// with encoding/json, fields at shallower depths take
+// precedence.
+func typeFields(typ reflect.Type) []*field {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	var fields []*field
+	seen := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+	current := []embedded{{typ, nil}}
+	for len(current) > 0 {
+		var next []embedded
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				opts := strings.Split(tag, ",")
+				name := opts[0]
+				index := append(append([]int{}, e.index...), i)
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{ft, index})
+						continue
+					}
+				}
+				if sf.PkgPath != "" {
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				f := &field{name: name, index: index}
+				for _, opt := range opts[1:] {
+					if opt == "omitempty" {
+						f.omitEmpty = true
+					}
+				}
+				fields = append(fields, f)
+			}
+		}
+		current = next
+	}
+	return fields
+}
+
+// fieldByIndex returns the nested field, allocating embedded
+// struct pointers if alloc is set. Otherwise, ok is false if
+// one of them is nil.
+func fieldByIndex(rv reflect.Value, index []int, alloc bool) (fv reflect.Value, ok bool) {
+	for i, idx := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !alloc {
+					return rv, false
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(idx)
+	}
+	return rv, true
+}
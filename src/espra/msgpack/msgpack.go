@@ -0,0 +1,302 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+// Package msgpack implements MessagePack encoding in the same
+// way as encoding/json, so that the same Go types can be sent
+// in either format.
+//
+// Struct fields are named by their json tags, and []byte
+// values are encoded as binary. Types which implement
+// json.Marshaler or json.Unmarshaler are transcoded from and to
+// their JSON encoding. Extension types aren't supported.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// MaxDepth limits the nesting of arrays and maps.
+const MaxDepth = 512
+
+var (
+	ErrMaxDepth  = errors.New("msgpack: exceeded maximum nesting depth")
+	ErrTrailing  = errors.New("msgpack: unexpected data after the top-level value")
+	ErrTruncated = errors.New("msgpack: unexpected end of data")
+)
+
+const (
+	nilToken = iota
+	boolToken
+	intToken
+	uintToken
+	floatToken
+	strToken
+	binToken
+	arrayToken
+	mapToken
+)
+
+var tokenNames = []string{"nil", "bool", "int", "uint", "float", "string", "binary", "array", "map"}
+
+// token is a single MessagePack value. The elements of arrays
+// and maps follow their token in the data.
+type token struct {
+	kind int
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	data []byte
+	n    int
+}
+
+func (t token) String() string {
+	return tokenNames[t.kind]
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of the given size.
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(0)
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *decoder) int(size int) (int64, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	shift := uint(64 - 8*size)
+	return int64(n<<shift) >> shift, nil
+}
+
+// length reads a length of the given size, and checks that it
+// doesn't exceed the remaining data given the minimum size of
+// each element.
+func (d *decoder) length(size, elemSize int) (int, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n*uint64(elemSize) > uint64(len(d.data)-d.pos) {
+		return 0, ErrTruncated
+	}
+	return int(n), nil
+}
+
+func (d *decoder) token() (t token, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return token{kind: intToken, i: int64(c)}, nil
+	case c <= 0x8f:
+		return token{kind: mapToken, n: int(c & 0x0f)}, nil
+	case c <= 0x9f:
+		return token{kind: arrayToken, n: int(c & 0x0f)}, nil
+	case c <= 0xbf:
+		t.kind = strToken
+		t.data, err = d.read(int(c & 0x1f))
+		return
+	case c >= 0xe0:
+		return token{kind: intToken, i: int64(int8(c))}, nil
+	}
+	var n uint64
+	switch c {
+	case 0xc0:
+		return token{kind: nilToken}, nil
+	case 0xc2, 0xc3:
+		return token{kind: boolToken, b: c == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		if n, err = d.uint(1 << (c - 0xc4)); err == nil {
+			t.kind = binToken
+			t.data, err = d.read(int(n))
+		}
+		return
+	case 0xca:
+		if n, err = d.uint(4); err == nil {
+			t = token{kind: floatToken, f: float64(math.Float32frombits(uint32(n)))}
+		}
+		return
+	case 0xcb:
+		if n, err = d.uint(8); err == nil {
+			t = token{kind: floatToken, f: math.Float64frombits(n)}
+		}
+		return
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if n, err = d.uint(1 << (c - 0xcc)); err == nil {
+			t = token{kind: uintToken, u: n}
+		}
+		return
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		t.kind = intToken
+		t.i, err = d.int(1 << (c - 0xd0))
+		return
+	case 0xd9, 0xda, 0xdb:
+		if n, err = d.uint(1 << (c - 0xd9)); err == nil {
+			t.kind = strToken
+			t.data, err = d.read(int(n))
+		}
+		return
+	case 0xdc, 0xdd:
+		t.kind = arrayToken
+		t.n, err = d.length(2<<(c-0xdc), 1)
+		return
+	case 0xde, 0xdf:
+		t.kind = mapToken
+		t.n, err = d.length(2<<(c-0xde), 2)
+		return
+	}
+	return t, fmt.Errorf("msgpack: unsupported type: 0x%02x", c)
+}
+
+// FromJSON converts the JSON value in data into MessagePack.
+// Object keys are sorted so that the output is deterministic.
+func FromJSON(data []byte) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(v)
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ToJSON converts the MessagePack value in data into JSON.
+// Binary values are converted into base64-encoded strings, as
+// used by encoding/json for []byte values. Map keys need to be
+// strings or integers.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data}
+	out := &bytes.Buffer{}
+	if err := d.json(out, 0); err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, ErrTrailing
+	}
+	return out.Bytes(), nil
+}
+
+func (d *decoder) json(out *bytes.Buffer, depth int) error {
+	t, err := d.token()
+	if err != nil {
+		return err
+	}
+	switch t.kind {
+	case nilToken:
+		out.WriteString("null")
+	case boolToken:
+		out.WriteString(strconv.FormatBool(t.b))
+	case intToken:
+		out.WriteString(strconv.FormatInt(t.i, 10))
+	case uintToken:
+		out.WriteString(strconv.FormatUint(t.u, 10))
+	case floatToken:
+		if math.IsInf(t.f, 0) || math.IsNaN(t.f) {
+			return fmt.Errorf("msgpack: unsupported float value: %v", t.f)
+		}
+		out.WriteString(strconv.FormatFloat(t.f, 'g', -1, 64))
+	case strToken:
+		enc, err := json.Marshal(string(t.data))
+		if err != nil {
+			return err
+		}
+		out.Write(enc)
+	case binToken:
+		out.WriteByte('"')
+		out.WriteString(base64.StdEncoding.EncodeToString(t.data))
+		out.WriteByte('"')
+	case arrayToken:
+		if depth >= MaxDepth {
+			return ErrMaxDepth
+		}
+		out.WriteByte('[')
+		for i := 0; i < t.n; i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := d.json(out, depth+1); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case mapToken:
+		if depth >= MaxDepth {
+			return ErrMaxDepth
+		}
+		out.WriteByte('{')
+		for i := 0; i < t.n; i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			enc, _ := json.Marshal(key)
+			out.Write(enc)
+			out.WriteByte(':')
+			if err := d.json(out, depth+1); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	}
+	return nil
+}
+
+// key reads a map key. Integer keys are converted into their
+// decimal form, as encoding/json does.
+func (d *decoder) key() (string, error) {
+	t, err := d.token()
+	if err != nil {
+		return "", err
+	}
+	switch t.kind {
+	case strToken:
+		return string(t.data), nil
+	case intToken:
+		return strconv.FormatInt(t.i, 10), nil
+	case uintToken:
+		return strconv.FormatUint(t.u, 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type: %s", t)
+}
@@ -0,0 +1,135 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package msgpack
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		`null`,
+		`true`,
+		`[false,0,127,128,255,256,65535,65536,4294967296,18446744073709551615]`,
+		`[-1,-32,-33,-128,-129,-32768,-32769,-2147483648,-2147483649,-9223372036854775808]`,
+		`[1.5,-0.25,1e+100]`,
+		`["","hello","` + strings.Repeat("x", 32) + `","` + strings.Repeat("y", 300) + `","é\n\""]`,
+		`{"a":{"b":[1,{"c":null}]},"d":[]}`,
+		`{"call":["item.create",{"by":"tav","parents":["#espra"]}],"header":{"auth":"xyz"}}`,
+	} {
+		packed, err := FromJSON([]byte(input))
+		if err != nil {
+			t.Fatalf("couldn't encode %s: %s", input, err)
+		}
+		output, err := ToJSON(packed)
+		if err != nil {
+			t.Fatalf("couldn't decode %s: %s", input, err)
+		}
+		if string(output) != input {
+			t.Errorf("round trip mismatch:\n got: %s\nwant: %s", output, input)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	for _, tt := range []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte{0xc4, 0x03, 'a', 'b', 'c'}, `"YWJj"`},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{[]byte{0x81, 0x01, 0xa1, 'x'}, `{"1":"x"}`},
+		{[]byte{0xdc, 0x00, 0x01, 0xc3}, `[true]`},
+	} {
+		output, err := ToJSON(tt.input)
+		if err != nil {
+			t.Fatalf("couldn't decode % x: %s", tt.input, err)
+		}
+		if string(output) != tt.expected {
+			t.Errorf("got %s for % x, expected %s", output, tt.input, tt.expected)
+		}
+	}
+	for _, input := range [][]byte{
+		{},
+		{0xa5, 'a'},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xc1},
+		{0xd4, 0x01, 0x00},
+		{0x81, 0xc3, 0xc3},
+		{0xc0, 0xc0},
+		bytes.Repeat([]byte{0x91}, MaxDepth+1),
+	} {
+		if _, err := ToJSON(input); err == nil {
+			t.Errorf("expected error decoding % x", input)
+		}
+	}
+}
+
+type stamp struct {
+	Seconds int64
+}
+
+func (s stamp) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(s.Seconds, 10)), nil
+}
+
+func (s *stamp) UnmarshalJSON(data []byte) (err error) {
+	s.Seconds, err = strconv.ParseInt(string(data), 10, 64)
+	return
+}
+
+type payload struct {
+	Blob    []byte            `json:"blob"`
+	Count   int               `json:"count,omitempty"`
+	Created stamp             `json:"created"`
+	Ignored string            `json:"-"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+func TestMarshal(t *testing.T) {
+	in := &payload{
+		Blob:    []byte("abc"),
+		Created: stamp{1370000000},
+		Ignored: "x",
+	}
+	packed, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("couldn't marshal: %s", err)
+	}
+	if !bytes.Contains(packed, []byte{0xa4, 'b', 'l', 'o', 'b', 0xc4, 0x03, 'a', 'b', 'c'}) {
+		t.Errorf("[]byte not encoded as binary: % x", packed)
+	}
+	output, err := ToJSON(packed)
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err)
+	}
+	if expected := `{"blob":"YWJj","created":1370000000}`; string(output) != expected {
+		t.Errorf("got %s, expected %s", output, expected)
+	}
+	out := &payload{}
+	if err := Unmarshal(packed, out); err != nil {
+		t.Fatalf("couldn't unmarshal: %s", err)
+	}
+	if string(out.Blob) != "abc" || out.Created.Seconds != 1370000000 || out.Ignored != "" {
+		t.Errorf("unexpected value: %#v", out)
+	}
+	var generic interface{}
+	if err := Unmarshal(packed, &generic); err != nil {
+		t.Fatalf("couldn't unmarshal into interface{}: %s", err)
+	}
+	obj := generic.(map[string]interface{})
+	if _, ok := obj["blob"].([]byte); !ok {
+		t.Errorf("binary value not decoded as []byte: %#v", obj["blob"])
+	}
+	if n, ok := obj["created"].(float64); !ok || n != 1370000000 {
+		t.Errorf("number not decoded as float64: %#v", obj["created"])
+	}
+	var small int8
+	if err := Unmarshal([]byte{0xcc, 0xff}, &small); err == nil {
+		t.Errorf("expected an overflow error, got %d", small)
+	}
+}
@@ -4,16 +4,17 @@
 package profile
 
 import (
-	"appengine/datastore"
 	"code.google.com/p/go.crypto/scrypt"
 	"crypto/subtle"
-	"errors"
+	"espra/auth"
 	"espra/datetime"
 	"espra/db"
 	"espra/ident"
+	"espra/kind"
 	"espra/rpc"
 	"espra/session"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,31 +25,28 @@ const (
 
 type LoginInfo struct {
 	Client     string `json:"client"`
-	Login      string `json:"login"`
-	Passphrase string `json:"passphrase"`
+	Login      string `json:"login" validate:"required"`
+	Passphrase string `json:"passphrase" validate:"required"`
 	RememberMe bool   `json:"remember_me"`
 }
 
 var (
-	ErrEmptyLogin      = errors.New("the login parameter cannot be empty")
-	ErrEmptyPassphrase = errors.New("the passphrase parameter cannot be empty")
-	ErrInvalidLogin    = errors.New("invalid login")
+	ErrAuthExpired   = rpc.NewError(rpc.AuthExpired, "auth expired")
+	ErrInvalidClient = rpc.NewError(rpc.Unauthorized, "invalid client")
+	ErrInvalidLogin  = rpc.NewError(rpc.Unauthorized, "invalid login")
 )
 
+// login(anon, ratelimit=10/1m)
+// Login authenticates the user with either their username or
+// email address and returns the auth token for a new session.
 func Login(ctx *rpc.Context, req *LoginInfo) (string, error) {
-	if req.Login == "" {
-		return "", ErrEmptyLogin
-	}
-	if req.Passphrase == "" {
-		return "", ErrEmptyPassphrase
-	}
 	var loginID int64
 	if strings.Contains(req.Login, "@") {
 		email := strings.ToLower(req.Login)
 		var meta db.LoginEmail
 		err := ctx.Get(ctx.StrKey("LE", email, nil), &meta)
 		if err != nil {
-			if err == datastore.ErrNoSuchEntity {
+			if err == rpc.ErrNoSuchEntity {
 				return "", ErrInvalidLogin
 			}
 			return "", err
@@ -62,7 +60,7 @@ func Login(ctx *rpc.Context, req *LoginInfo) (string, error) {
 		var meta db.LoginUsername
 		err := ctx.Get(ctx.StrKey("LU", username, nil), &meta)
 		if err != nil {
-			if err == datastore.ErrNoSuchEntity {
+			if err == rpc.ErrNoSuchEntity {
 				return "", ErrInvalidLogin
 			}
 			return "", err
@@ -73,7 +71,7 @@ func Login(ctx *rpc.Context, req *LoginInfo) (string, error) {
 	loginKey := ctx.IntKey("L", loginID, nil)
 	err := ctx.Get(loginKey, &login)
 	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
+		if err == rpc.ErrNoSuchEntity {
 			return "", ErrInvalidLogin
 		}
 		return "", err
@@ -86,6 +84,11 @@ func Login(ctx *rpc.Context, req *LoginInfo) (string, error) {
 	if subtle.ConstantTimeCompare(derived, login.Passphrase) != 1 {
 		return "", ErrInvalidLogin
 	}
+	if req.Client != "" {
+		if _, err := clientToken(ctx, loginKey, req.Client); err != nil {
+			return "", err
+		}
+	}
 	now := datetime.UTC()
 	sess := &db.Session{
 		Client:     req.Client,
@@ -100,34 +103,91 @@ func Login(ctx *rpc.Context, req *LoginInfo) (string, error) {
 	return session.Encode(login.Username, string(sess.Expires)[1:], loginKey.IntID(), key.IntID()), nil
 }
 
+// session.renew
+// SessionRenew exchanges an auth token for a new one.
 func SessionRenew(ctx *rpc.Context, auth string) (string, bool) {
 	return "", false
 }
 
+// clientToken returns the ClientToken identified by the
+// session's client ID. Client tokens are children of the login
+// like its sessions, and are only valid until they expire.
+func clientToken(ctx *rpc.Context, loginKey *rpc.Key, client string) (*db.ClientToken, error) {
+	id, err := strconv.ParseInt(client, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, ErrInvalidClient
+	}
+	token := &db.ClientToken{}
+	if err = ctx.Get(ctx.IntKey(kind.ClientToken, id, loginKey), token); err != nil {
+		if err == rpc.ErrNoSuchEntity {
+			return nil, ErrInvalidClient
+		}
+		return nil, err
+	}
+	if token.Expires != "" && token.Expires < datetime.Now() {
+		return nil, ErrInvalidClient
+	}
+	return token, nil
+}
+
+// Scopes resolves the scopes granted to the caller from the
+// Session identified by the auth token. Sessions created for a
+// client are limited to the space separated Scopes of its
+// ClientToken. First-party sessions, i.e. those created by
+// logging in without a client, act with the full authority of
+// the user and so are granted all scopes.
+func Scopes(ctx *rpc.Context) ([]string, error) {
+	token, _ := ctx.Header["auth"].(string)
+	_, _, loginID, sessionID, ok := auth.Decode(token)
+	if !ok {
+		return nil, ErrAuthExpired
+	}
+	var sess db.Session
+	loginKey := ctx.IntKey("L", loginID, nil)
+	err := ctx.Get(ctx.IntKey("S", sessionID, loginKey), &sess)
+	if err != nil {
+		if err == rpc.ErrNoSuchEntity {
+			return nil, ErrAuthExpired
+		}
+		return nil, err
+	}
+	if sess.Client == "" {
+		return []string{"*"}, nil
+	}
+	client, err := clientToken(ctx, loginKey, sess.Client)
+	if err != nil {
+		if err == ErrInvalidClient {
+			return nil, ErrAuthExpired
+		}
+		return nil, err
+	}
+	return strings.Fields(client.Scopes), nil
+}
+
+// signup(anon, idempotent=24h)
+// Signup creates a new account.
 func Signup(ctx *rpc.Context, req *LoginInfo) (bool, string, error) {
 	return false, "", nil
 }
 
+// signup.details(anon)
 func SignupDetails(ctx *rpc.Context) {
 
 }
 
-func Gravatar(ctx *rpc.Context, username string, size string) error {
+// profile.gravatar(get, params=username size=150, cache)
+// Gravatar redirects to the avatar image for the user.
+func Gravatar(ctx *rpc.Context, username string, size uint64) error {
 	validatedUsername, ok := ident.Username(username)
 	if !ok {
-		return fmt.Errorf("invalid username: %s", username)
+		return rpc.NewError(rpc.BadRequest, "invalid username: %s", username)
 	}
-	imageSize := ctx.ParseUint(size, "invalid size parameter: %s", 150)
-	ctx.App.Infof("foo %s", validatedUsername)
+	ctx.Backend.Infof("foo %s", validatedUsername)
 	digest := "6cf15f03f4e93f91688b7e6b945c469e"
-	ctx.Redirect(fmt.Sprintf("https://secure.gravatar.com/avatar/%s?s=%d&d=%s", digest, imageSize, defaultGravatar))
+	ctx.Redirect(fmt.Sprintf("https://secure.gravatar.com/avatar/%s?s=%d&d=%s", digest, size, defaultGravatar))
 	return nil
 }
 
 func init() {
-	rpc.Register("login", Login).Anon()
-	rpc.Register("session.renew", SessionRenew)
-	rpc.Register("signup", Signup).Anon()
-	rpc.Register("signup.details", Signup).Anon()
-	rpc.RegisterGet("profile.gravatar", Gravatar).Cache(rpc.LongCache)
+	rpc.SetScopeResolver(Scopes)
 }
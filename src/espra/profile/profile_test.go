@@ -0,0 +1,59 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package profile
+
+import (
+	"espra/datetime"
+	"espra/db"
+	"espra/item"
+	"espra/kind"
+	"espra/rpc"
+	"espra/rpc/rpctest"
+	"espra/session"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	rpc.Register("item.create", item.Create).Scopes("items:write")
+}
+
+func TestScopes(t *testing.T) {
+
+	c := rpctest.New("tav")
+	loginKey := rpc.NewKey("L", "", 1, nil)
+	expires := datetime.From(time.Now().Add(time.Hour))
+	key, err := c.Backend.Put(rpc.NewKey("S", "", 0, loginKey), &db.Session{Expires: expires})
+	if err != nil {
+		t.Fatalf("couldn't create the session: %s", err)
+	}
+
+	c.Header["auth"] = session.Encode("tav", string(expires)[1:], loginKey.IntID(), key.IntID())
+	res := c.Call("item.create", &item.CreateRequest{By: "tav", Space: "#espra"})
+	if res.Err != nil {
+		t.Fatalf("unexpected error creating an item with a session: %s", res.Err)
+	}
+
+	c.Backend.Delete(key)
+	res = c.Call("item.create", &item.CreateRequest{By: "tav", Space: "#espra"})
+	if res.Err == nil || res.Err.Code != rpc.AuthExpired {
+		t.Fatalf("expected an auth expired error for a deleted session, got %v", res.Err)
+	}
+
+	client, _ := c.Backend.Put(rpc.NewKey(kind.ClientToken, "", 0, loginKey), &db.ClientToken{Scopes: "items:read"})
+	key, err = c.Backend.Put(rpc.NewKey("S", "", 0, loginKey), &db.Session{
+		Client:  strconv.FormatInt(client.IntID(), 10),
+		Expires: expires,
+	})
+	if err != nil {
+		t.Fatalf("couldn't create the client session: %s", err)
+	}
+	c.Header["auth"] = session.Encode("tav", string(expires)[1:], loginKey.IntID(), key.IntID())
+	res = c.Call("item.create", &item.CreateRequest{By: "tav", Space: "#espra"})
+	if res.Err == nil || res.Err.Code != rpc.Forbidden {
+		t.Fatalf("expected a client token with items:read to be forbidden from item.create, got %v", res.Err)
+	}
+
+}
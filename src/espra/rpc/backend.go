@@ -0,0 +1,175 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNestedTransaction = errors.New("rpc: transactions can't be nested")
+	ErrNoSuchEntity      = errors.New("rpc: no such entity")
+)
+
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
+}
+
+// Backend provides the storage and logging operations used by
+// services. Get and GetAll need to return ErrNoSuchEntity for
+// missing entities so that services can stay independent of
+// the underlying implementation.
+//
+// RunInTransaction runs f atomically, with the operations on
+// the given tx Backend forming a transaction. It may retry f
+// if the transaction fails to commit due to contention.
+//
+// WithDeadline returns a Backend whose operations are
+// cancelled if they haven't completed by the deadline.
+type Backend interface {
+	Logger
+	Delete(key *Key) error
+	Get(key *Key, dst interface{}) error
+	GetAll(q *Query, dst interface{}) ([]*Key, error)
+	Put(key *Key, src interface{}) (*Key, error)
+	RunInTransaction(f func(tx Backend) error) error
+	WithDeadline(deadline time.Time) Backend
+}
+
+var (
+	memoryBackend = NewMemoryBackend()
+	newBackend    = func(r *http.Request) Backend {
+		return memoryBackend
+	}
+)
+
+// SetBackend sets the function used to create the Backend for
+// each request. By default, all requests share a single
+// in-memory backend.
+func SetBackend(f func(r *http.Request) Backend) {
+	newBackend = f
+}
+
+// Key identifies an entity. Keys with neither a string nor an
+// integer ID are incomplete and have an ID allocated when they
+// are first Put.
+type Key struct {
+	kind     string
+	stringID string
+	intID    int64
+	parent   *Key
+}
+
+func NewKey(kind, stringID string, intID int64, parent *Key) *Key {
+	return &Key{kind, stringID, intID, parent}
+}
+
+func (k *Key) Kind() string {
+	return k.kind
+}
+
+func (k *Key) StringID() string {
+	return k.stringID
+}
+
+func (k *Key) IntID() int64 {
+	return k.intID
+}
+
+func (k *Key) Parent() *Key {
+	return k.parent
+}
+
+func (k *Key) Incomplete() bool {
+	return k.stringID == "" && k.intID == 0
+}
+
+func (k *Key) Equal(o *Key) bool {
+	for k != nil && o != nil {
+		if k.kind != o.kind || k.stringID != o.stringID || k.intID != o.intID {
+			return false
+		}
+		k, o = k.parent, o.parent
+	}
+	return k == o
+}
+
+// HasAncestor returns whether the key is equal to, or is a
+// descendant of, the given ancestor.
+func (k *Key) HasAncestor(ancestor *Key) bool {
+	for ; k != nil; k = k.parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a path-like representation of the key, e.g.
+// /A,1/S,2 or /LU,"tav".
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	id := strconv.FormatInt(k.intID, 10)
+	if k.stringID != "" {
+		id = strconv.Quote(k.stringID)
+	}
+	return k.parent.String() + "/" + k.kind + "," + id
+}
+
+// Query describes a query over the entities of a particular
+// Kind. Filter and Order can be used to build it up, e.g.
+//
+//	q := rpc.NewQuery(kind.Item).Filter("s =", space).Order("-c")
+type Query struct {
+	Kind     string
+	Ancestor *Key
+	Filters  []Filter
+	Orders   []string
+	Limit    int
+	Offset   int
+	KeysOnly bool
+}
+
+// Filter specifies a condition on a property. The Op is one
+// of =, <, <=, > or >=.
+type Filter struct {
+	Property string
+	Op       string
+	Value    interface{}
+}
+
+func NewQuery(kind string) *Query {
+	return &Query{Kind: kind}
+}
+
+// Filter adds a filter of the form "property op", e.g. "s >=".
+// The op defaults to = if it's not specified.
+func (q *Query) Filter(spec string, value interface{}) *Query {
+	f := Filter{Op: "=", Value: value}
+	spec = strings.TrimSpace(spec)
+	if idx := strings.LastIndex(spec, " "); idx != -1 {
+		f.Property, f.Op = strings.TrimSpace(spec[:idx]), spec[idx+1:]
+	} else {
+		f.Property = spec
+	}
+	q.Filters = append(q.Filters, f)
+	return q
+}
+
+// Order adds a sort order on the given property. Properties
+// with a - prefix are sorted in descending order.
+func (q *Query) Order(property string) *Query {
+	q.Orders = append(q.Orders, property)
+	return q
+}
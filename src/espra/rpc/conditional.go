@@ -0,0 +1,80 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type notModified struct{}
+
+// ETag sets the entity tag for the response of a GET service.
+// If the tag matches the request's If-None-Match header, the
+// call is aborted and a 304 Not Modified response is sent.
+// Services can therefore use this to cheaply validate a
+// client's cached copy before doing any expensive work.
+func (ctx *Context) ETag(tag string) {
+	if !strings.HasPrefix(tag, `"`) && !strings.HasPrefix(tag, `W/"`) {
+		tag = `"` + tag + `"`
+	}
+	ctx.etag = tag
+	ctx.checkModified()
+}
+
+// LastModified sets the last modification time for the
+// response of a GET service. Like ETag, it aborts the call if
+// the client's cached copy is still valid.
+func (ctx *Context) LastModified(t time.Time) {
+	ctx.modified = t.UTC().Truncate(time.Second)
+	ctx.checkModified()
+}
+
+func (ctx *Context) checkModified() {
+	if ctx.r != nil && isNotModified(ctx.r, ctx.etag, ctx.modified) {
+		panic(notModified{})
+	}
+}
+
+func (ctx *Context) setValidators(w http.ResponseWriter) {
+	if ctx.etag != "" {
+		w.Header().Set("ETag", ctx.etag)
+	}
+	if !ctx.modified.IsZero() {
+		w.Header().Set("Last-Modified", ctx.modified.Format(http.TimeFormat))
+	}
+}
+
+// isNotModified returns whether the conditional headers of
+// the request match the given validators. If-None-Match takes
+// precedence over If-Modified-Since as per RFC 2616.
+func isNotModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if etag == "" {
+			return false
+		}
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !modified.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
+
+func computeETag(content []byte) string {
+	hash := sha1.New()
+	hash.Write(content)
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
@@ -0,0 +1,150 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"time"
+)
+
+var ErrDeadlineExceeded = NewError(Timeout, "deadline exceeded")
+
+// Timeout sets the maximum duration for calls to the service.
+// When it is exceeded, the client is sent a timeout error and
+// the call's Done channel is closed so that any subsequent
+// storage operations fail with ErrDeadlineExceeded. The call's
+// Backend is also bound to the deadline, so that operations
+// which are in flight get cancelled.
+//
+// A mutation which was being committed as the deadline passed
+// may still have been applied though. Services which need to
+// be retried safely should therefore also be made Idempotent.
+func (s *service) Timeout(d time.Duration) *service {
+	s.timeout = d
+	return s
+}
+
+// Deadline returns the time by which the current call needs to
+// complete. The ok value is false if the service doesn't have
+// a timeout.
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+// Done returns a channel that is closed when the deadline for
+// the current call passes. It returns nil for services without
+// a timeout.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.done
+}
+
+// Err returns ErrDeadlineExceeded once the Done channel has
+// been closed, and nil otherwise.
+func (ctx *Context) Err() error {
+	select {
+	case <-ctx.done:
+		return ErrDeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+type outcome struct {
+	reply []interface{}
+	err   error
+	panic interface{}
+}
+
+// failure returns the value that the call would have panicked
+// with, or nil if it succeeded.
+func (o *outcome) failure() interface{} {
+	if o.panic != nil {
+		return o.panic
+	}
+	if o.err != nil {
+		return toError(o.err)
+	}
+	return nil
+}
+
+// detach returns a new Context for running the current call
+// in a separate goroutine. It has its own maps and doesn't
+// share the buffers of the pooled context, so that the call
+// can carry on running after it has been abandoned without
+// affecting subsequent requests. The Backend is created for
+// each request, so it's safe for the two to share it, with the
+// detached context using a version bound to the deadline.
+func (ctx *Context) detach(timeout time.Duration) *Context {
+	deadline := time.Now().Add(timeout)
+	sub := &Context{
+		Backend:    ctx.Backend.WithDeadline(deadline),
+		Header:     Header{},
+		RequestID:  ctx.RequestID,
+		Username:   ctx.Username,
+		authDone:   ctx.authDone,
+		authErr:    ctx.authErr,
+		deadline:   deadline,
+		done:       make(chan struct{}),
+		etag:       ctx.etag,
+		ip:         ctx.ip,
+		meth:       ctx.meth,
+		modified:   ctx.modified,
+		r:          ctx.r,
+		req:        &request{},
+		scopes:     ctx.scopes,
+		scopesDone: ctx.scopesDone,
+		scopesErr:  ctx.scopesErr,
+		user:       ctx.user,
+	}
+	for k, v := range ctx.Header {
+		sub.Header[k] = v
+	}
+	if ctx.RespHeader != nil {
+		sub.RespHeader = Header{}
+		for k, v := range ctx.RespHeader {
+			sub.RespHeader[k] = v
+		}
+	}
+	return sub
+}
+
+// invokeTimeout runs the service call in a separate goroutine
+// on a detached context. If the deadline passes, the goroutine
+// is abandoned and the original context is left untouched, so
+// that it can be safely reused. Any abandon function set on
+// the context is handed the outcome once the call finishes.
+func (ctx *Context) invokeTimeout(s *service, args []interface{}) []interface{} {
+	sub := ctx.detach(s.timeout)
+	ch := make(chan *outcome, 1)
+	go func() {
+		o := &outcome{}
+		defer func() {
+			o.panic = capturePanic(recover())
+			ch <- o
+		}()
+		o.reply, o.err = s.handler(sub.meth)(sub, args)
+	}()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case o := <-ch:
+		ctx.etag, ctx.modified = sub.etag, sub.modified
+		for k, v := range sub.RespHeader {
+			ctx.RespHeader[k] = v
+		}
+		if e := o.failure(); e != nil {
+			panic(e)
+		}
+		return o.reply
+	case <-timer.C:
+		close(sub.done)
+		if finish := ctx.abandon; finish != nil {
+			ctx.abandon = nil
+			go func() {
+				finish(sub, <-ch)
+			}()
+		}
+		Raise(Timeout, "%s exceeded its deadline of %s", ctx.meth, s.timeout)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+type deadlineBackend struct {
+	*MemoryBackend
+	deadline time.Time
+}
+
+func (b *deadlineBackend) WithDeadline(deadline time.Time) Backend {
+	return &deadlineBackend{b.MemoryBackend, deadline}
+}
+
+func TestTimeout(t *testing.T) {
+
+	release := make(chan struct{})
+	finished := make(chan error, 1)
+	Register("deadlinetest.slow", func(ctx *Context) {
+		<-release
+		ctx.RespHeader["slow"] = true
+		_, err := ctx.Put(NewKey("DT", "", 0, nil), &testEntity{Name: "late"})
+		finished <- err
+	}).Timeout(10 * time.Millisecond)
+
+	ctx := NewContext(NewMemoryBackend(), "tav", nil)
+	_, _, err := ctx.Call("deadlinetest.slow", nil)
+	if err == nil || err.Code != Timeout {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+
+	close(release)
+	if err := <-finished; err != ErrDeadlineExceeded {
+		t.Errorf("expected the abandoned call to fail with ErrDeadlineExceeded, got %v", err)
+	}
+	if _, exists := ctx.RespHeader["slow"]; exists {
+		t.Errorf("the abandoned call modified the original context")
+	}
+
+	bound := make(chan bool, 1)
+	Register("deadlinetest.bound", func(ctx *Context) {
+		deadline, _ := ctx.Deadline()
+		b, ok := ctx.Backend.(*deadlineBackend)
+		bound <- ok && b.deadline.Equal(deadline)
+	}).Timeout(time.Second)
+
+	NewContext(&deadlineBackend{MemoryBackend: NewMemoryBackend()}, "tav", nil).Call("deadlinetest.bound", nil)
+	if !<-bound {
+		t.Errorf("the backend wasn't bound to the call's deadline")
+	}
+
+}
@@ -0,0 +1,255 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema describes the wire format of an argument or result
+// type. The Type is one of any, bool, bytes, float, int, list,
+// map, object, string, time or uint. Recursive references to
+// an object which is already being described are given by
+// just its Name.
+type Schema struct {
+	Type     string         `json:"type"`
+	Name     string         `json:"name,omitempty"`
+	Nullable bool           `json:"nullable,omitempty"`
+	Elem     *Schema        `json:"elem,omitempty"`
+	Fields   []*FieldSchema `json:"fields,omitempty"`
+}
+
+type FieldSchema struct {
+	Name      string  `json:"name"`
+	OmitEmpty bool    `json:"omitempty,omitempty"`
+	Validate  string  `json:"validate,omitempty"`
+	Schema    *Schema `json:"schema"`
+}
+
+type ParamInfo struct {
+	Name    string      `json:"name"`
+	Default interface{} `json:"default,omitempty"`
+}
+
+// ServiceInfo describes a registered service as returned by
+// the rpc.describe service.
+type ServiceInfo struct {
+	Name       string       `json:"name"`
+	Anon       bool         `json:"anon"`
+	Cache      int          `json:"cache"`
+	Error      bool         `json:"error"`
+	Get        bool         `json:"get"`
+	In         []*Schema    `json:"in"`
+	Out        []*Schema    `json:"out"`
+	Params     []*ParamInfo `json:"params,omitempty"`
+	Scopes     []string     `json:"scopes,omitempty"`
+	Version    int          `json:"version"`
+	Deprecated bool         `json:"deprecated,omitempty"`
+	Notice     string       `json:"notice,omitempty"`
+}
+
+var (
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+)
+
+// typeName returns the qualified name of named types which
+// aren't predeclared, e.g. db.User.
+func typeName(t reflect.Type) string {
+	path := t.PkgPath()
+	if path == "" {
+		return ""
+	}
+	return path[strings.LastIndex(path, "/")+1:] + "." + t.Name()
+}
+
+func describeType(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	if t.Kind() == reflect.Ptr {
+		schema := describeType(t.Elem(), seen)
+		schema.Nullable = true
+		return schema
+	}
+	schema := &Schema{Name: typeName(t)}
+	if t == timeType {
+		schema.Type = "time"
+		return schema
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		schema.Type = "any"
+		return schema
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		schema.Type = "bool"
+	case reflect.Float32, reflect.Float64:
+		schema.Type = "float"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		schema.Type = "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		schema.Type = "uint"
+	case reflect.String:
+		schema.Type = "string"
+	case reflect.Array, reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			schema.Type = "bytes"
+		} else {
+			schema.Type = "list"
+			schema.Elem = describeType(t.Elem(), seen)
+		}
+		schema.Nullable = t.Kind() == reflect.Slice
+	case reflect.Map:
+		schema.Type = "map"
+		schema.Elem = describeType(t.Elem(), seen)
+		schema.Nullable = true
+	case reflect.Struct:
+		schema.Type = "object"
+		if seen[t] {
+			return schema
+		}
+		seen[t] = true
+		schema.Fields = describeFields(t, seen)
+		delete(seen, t)
+	default:
+		schema.Type = "any"
+	}
+	return schema
+}
+
+func describeFields(t reflect.Type, seen map[reflect.Type]bool) []*FieldSchema {
+	fields := []*FieldSchema{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if field.Anonymous && tag[0] == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, describeFields(ft, seen)...)
+				continue
+			}
+		}
+		fs := &FieldSchema{
+			Name:     field.Name,
+			Validate: field.Tag.Get("validate"),
+			Schema:   describeType(field.Type, seen),
+		}
+		if tag[0] != "" {
+			fs.Name = tag[0]
+		}
+		for _, opt := range tag[1:] {
+			switch opt {
+			case "omitempty":
+				fs.OmitEmpty = true
+			case "string":
+				fs.Schema.Type = "string"
+			}
+		}
+		fields = append(fields, fs)
+	}
+	return fields
+}
+
+func describeService(name string, s *service) *ServiceInfo {
+	info := &ServiceInfo{
+		Name:       name,
+		Anon:       s.anon,
+		Cache:      s.cache,
+		Error:      s.retErr,
+		Get:        s.isGet,
+		In:         make([]*Schema, s.in),
+		Out:        []*Schema{},
+		Scopes:     s.scopes,
+		Version:    s.version,
+		Deprecated: s.deprecated,
+		Notice:     s.notice,
+	}
+	for i, typ := range s.args {
+		info.In[i] = describeType(typ, map[reflect.Type]bool{})
+	}
+	rt := s.meth.Type()
+	out := rt.NumOut()
+	if s.retErr {
+		out -= 1
+	}
+	for i := 0; i < out; i++ {
+		info.Out = append(info.Out, describeType(rt.Out(i), map[reflect.Type]bool{}))
+	}
+	for _, p := range s.params {
+		info.Params = append(info.Params, &ParamInfo{p.name, p.value})
+	}
+	return info
+}
+
+type serviceInfoList []*ServiceInfo
+
+func (l serviceInfoList) Len() int {
+	return len(l)
+}
+
+func (l serviceInfoList) Less(i, j int) bool {
+	if l[i].Name == l[j].Name {
+		if l[i].Get != l[j].Get {
+			return !l[i].Get
+		}
+		return l[i].Version < l[j].Version
+	}
+	return l[i].Name < l[j].Name
+}
+
+func (l serviceInfoList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Describe returns a description of all the registered
+// services, sorted by name. It is built on each call so that
+// services registered later on are included.
+func Describe() []*ServiceInfo {
+	registry := []*ServiceInfo{}
+	for name, versions := range services {
+		for _, s := range versions {
+			registry = append(registry, describeService(name, s))
+		}
+	}
+	for name, s := range getServices {
+		registry = append(registry, describeService(name, s))
+	}
+	sort.Sort(serviceInfoList(registry))
+	return registry
+}
+
+// describe only lists the services which the authenticated
+// caller has been granted the scopes for.
+func describe(ctx *Context) []*ServiceInfo {
+	granted, err := ctx.grantedScopes()
+	infos := []*ServiceInfo{}
+	for _, info := range Describe() {
+		allowed := true
+		for _, scope := range info.Scopes {
+			if err != nil || !HasScope(granted, scope) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func init() {
+	Register("rpc.describe", describe)
+}
@@ -0,0 +1,40 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"testing"
+)
+
+func describeNames(t *testing.T, ctx *Context) map[string]bool {
+	reply, _, err := ctx.Call("rpc.describe", nil)
+	if err != nil {
+		t.Fatalf("unexpected error from rpc.describe: %s", err)
+	}
+	names := map[string]bool{}
+	for _, info := range reply[0].([]*ServiceInfo) {
+		names[info.Name] = true
+	}
+	return names
+}
+
+func TestDescribe(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	if _, _, err := NewContext(backend, "", nil).Call("rpc.describe", nil); err == nil || err.Code != AuthRequired {
+		t.Fatalf("expected rpc.describe to require auth, got %v", err)
+	}
+
+	Register("describetest.admin", func(ctx *Context) {}).Scopes("admin")
+	names := describeNames(t, NewContext(backend, "tav", []string{}))
+	if !names["rpc.describe"] || names["describetest.admin"] {
+		t.Errorf("got unexpected services for a caller without scopes: %v", names)
+	}
+
+	names = describeNames(t, NewContext(backend, "tav", []string{"admin"}))
+	if !names["describetest.admin"] {
+		t.Errorf("service registered after the first describe is missing: %v", names)
+	}
+
+}
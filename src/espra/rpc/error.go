@@ -0,0 +1,109 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// These constants define the machine-readable codes that are
+// sent to clients as part of an error response.
+const (
+	AuthExpired      = "auth_expired"
+	AuthRequired     = "auth_required"
+	BadRequest       = "bad_request"
+	Conflict         = "conflict"
+	Forbidden        = "forbidden"
+	InternalError    = "internal_error"
+	MethodNotAllowed = "method_not_allowed"
+	RateLimited      = "rate_limited"
+	ServiceError     = "service_error"
+	ServiceNotFound  = "service_not_found"
+	Timeout          = "timeout"
+	Unauthorized     = "unauthorized"
+)
+
+var statusCodes = map[string]int{
+	AuthExpired:      http.StatusUnauthorized,
+	AuthRequired:     http.StatusUnauthorized,
+	BadRequest:       http.StatusBadRequest,
+	Conflict:         http.StatusConflict,
+	Forbidden:        http.StatusForbidden,
+	InternalError:    http.StatusInternalServerError,
+	MethodNotAllowed: http.StatusMethodNotAllowed,
+	RateLimited:      429,
+	ServiceError:     http.StatusInternalServerError,
+	ServiceNotFound:  http.StatusNotFound,
+	Timeout:          http.StatusGatewayTimeout,
+	Unauthorized:     http.StatusUnauthorized,
+}
+
+// Error represents a structured error that can be returned
+// by, or raised within, services.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status returns the HTTP status code for the error.
+func (e *Error) Status() int {
+	if status, ok := statusCodes[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func NewError(code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Raise panics with a new Error so as to abort the current
+// service call.
+func Raise(code, format string, a ...interface{}) {
+	panic(NewError(code, format, a...))
+}
+
+func toError(e interface{}) *Error {
+	switch err := e.(type) {
+	case *Error:
+		return err
+	case error:
+		return &Error{Code: ServiceError, Message: err.Error()}
+	}
+	return &Error{Code: InternalError, Message: fmt.Sprint(e)}
+}
+
+type errorResponse struct {
+	Header Header `json:"header,omitempty"`
+	Error  *Error `json:"error"`
+}
+
+var errEnc = []byte(`{"error":{"code":"internal_error","message":"couldn't encode JSON response"}}`)
+
+// writeError writes the error response, along with the
+// response header if there is one.
+func writeError(w http.ResponseWriter, hdr Header, err *Error) {
+	resp, e := json.Marshal(&errorResponse{hdr, err})
+	if e != nil {
+		resp = errEnc
+	}
+	sendError(w, "application/json", resp, err)
+}
+
+func sendError(w http.ResponseWriter, contentType string, resp []byte, err *Error) {
+	if info, ok := err.Data.(*RetryInfo); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(info.RetryAfter))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(err.Status())
+	w.Write(resp)
+}
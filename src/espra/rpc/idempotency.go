@@ -0,0 +1,234 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInProgress = NewError(Conflict, "a call with the same idempotency key is still in progress")
+	ErrKeyReused  = NewError(Conflict, "the idempotency key has already been used with different arguments")
+)
+
+// IdempotentReply is the stored outcome of an idempotent call
+// which is replayed to clients retrying with the same key. The
+// Args hash is used to detect keys being reused for calls with
+// different arguments.
+type IdempotentReply struct {
+	Args  string            `json:"args"`
+	Reply []json.RawMessage `json:"reply,omitempty"`
+	Error *Error            `json:"error,omitempty"`
+}
+
+// IdempotencyStore keeps track of idempotency keys. Reserve
+// needs to atomically mark an unused key as in progress for
+// the duration of the lease and return a nil reply. If the key
+// has already been used, it returns the saved reply, or
+// ErrInProgress if the original call hasn't finished yet. Save
+// stores the reply for the full window.
+type IdempotencyStore interface {
+	Reserve(ctx *Context, key string, lease time.Duration) (*IdempotentReply, error)
+	Save(ctx *Context, key string, reply *IdempotentReply, window time.Duration) error
+	Release(ctx *Context, key string) error
+}
+
+var idempotencyStore IdempotencyStore = NewMemoryIdempotencyStore()
+
+// IdempotencyLease is how long keys are held in progress for,
+// so that they become usable again if an instance fails in the
+// middle of a call. Services with a longer Timeout hold them
+// for that long instead, as abandoned calls may still finish.
+var IdempotencyLease = time.Minute
+
+func (s *service) idempotencyLease() time.Duration {
+	if s.timeout > IdempotencyLease {
+		return s.timeout
+	}
+	return IdempotencyLease
+}
+
+// SetIdempotencyStore sets the store used for idempotency keys.
+// By default, keys are kept in memory.
+func SetIdempotencyStore(store IdempotencyStore) {
+	idempotencyStore = store
+}
+
+// Idempotent lets clients safely retry calls to the service
+// by specifying an 'idempotency' header field. The reply to
+// the first call with a given key is saved for the window and
+// replayed on subsequent calls with the same arguments by the
+// same user, or from the same IP address for anonymous calls.
+func (s *service) Idempotent(window time.Duration) *service {
+	if s.isGet {
+		panic("rpc: GET services cannot be idempotent")
+	}
+	if window <= 0 {
+		panic("rpc: the idempotency window needs to be positive")
+	}
+	s.idempotent = window
+	return s
+}
+
+// idempotencyKey derives the store key from the client's key,
+// the caller and the service, so that retries match wherever
+// they occur within a batch. Anonymous callers are identified
+// by their IP address so that they can't replay each other's
+// replies.
+func (ctx *Context) idempotencyKey(token string) string {
+	caller := "ip:" + ctx.ip
+	if ctx.Username != "" {
+		caller = "user:" + ctx.Username
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s", caller, ctx.meth, token)
+	return "idempotency:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+func hashArgs(args []interface{}) string {
+	hash := sha1.New()
+	if err := json.NewEncoder(hash).Encode(args); err != nil {
+		Raise(BadRequest, "couldn't encode arguments: %s", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// invokeIdempotent invokes the service unless a reply has
+// already been saved for the 'idempotency' header field.
+// Successful replies and client errors are saved, whilst other
+// failures release the key so that the call can be retried.
+// If the call times out, the key is kept reserved until the
+// abandoned call finishes, as it may still make changes.
+func (ctx *Context) invokeIdempotent(s *service, args []interface{}) (reply []interface{}) {
+	v, exists := ctx.Header["idempotency"]
+	if !exists {
+		return ctx.invoke(s, args)
+	}
+	token, ok := v.(string)
+	if !ok || token == "" {
+		Raise(BadRequest, "'idempotency' header field needs to be a non-empty string")
+	}
+	key, hash := ctx.idempotencyKey(token), hashArgs(args)
+	prev, err := idempotencyStore.Reserve(ctx, key, s.idempotencyLease())
+	if err != nil {
+		panic(err)
+	}
+	if prev != nil {
+		if prev.Args != hash {
+			panic(ErrKeyReused)
+		}
+		ctx.RespHeader["replayed"] = true
+		if prev.Error != nil {
+			panic(prev.Error)
+		}
+		reply := make([]interface{}, len(prev.Reply))
+		for i, raw := range prev.Reply {
+			reply[i] = raw
+		}
+		return reply
+	}
+	backend := ctx.Backend
+	ctx.abandon = func(sub *Context, o *outcome) {
+		// The detached context's Backend is bound to the deadline
+		// which has already passed.
+		sub.Backend = backend
+		sub.settleIdempotent(key, hash, s.idempotent, o.reply, o.failure())
+	}
+	defer func() {
+		e := recover()
+		if ctx.abandon != nil {
+			ctx.abandon = nil
+			ctx.settleIdempotent(key, hash, s.idempotent, reply, e)
+		}
+		if e != nil {
+			panic(e)
+		}
+	}()
+	return ctx.invoke(s, args)
+}
+
+// settleIdempotent saves the outcome of a call so that it can
+// be replayed, or releases the key if the call can be retried.
+func (ctx *Context) settleIdempotent(key, hash string, window time.Duration, reply []interface{}, e interface{}) {
+	if e == nil {
+		saved := &IdempotentReply{Args: hash, Reply: make([]json.RawMessage, len(reply))}
+		for i, v := range reply {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				e = fmt.Errorf("couldn't encode reply: %s", err)
+				break
+			}
+			saved.Reply[i] = raw
+		}
+		if e == nil {
+			ctx.saveIdempotent(key, saved, window)
+			return
+		}
+	}
+	if err, ok := e.(*Error); ok && err.Status() < 500 {
+		ctx.saveIdempotent(key, &IdempotentReply{Args: hash, Error: err}, window)
+	} else if err := idempotencyStore.Release(ctx, key); err != nil {
+		ctx.Backend.Errorf("rpc: couldn't release idempotency key for %s: %s", ctx.meth, err)
+	}
+}
+
+func (ctx *Context) saveIdempotent(key string, reply *IdempotentReply, window time.Duration) {
+	if err := idempotencyStore.Save(ctx, key, reply, window); err != nil {
+		ctx.Backend.Errorf("rpc: couldn't save idempotent reply for %s: %s", ctx.meth, err)
+	}
+}
+
+type idempotencyEntry struct {
+	expires time.Time
+	reply   *IdempotentReply
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore which keeps
+// keys in memory and is only suitable for single instances.
+type MemoryIdempotencyStore struct {
+	entries map[string]*idempotencyEntry
+	mutex   sync.Mutex
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: map[string]*idempotencyEntry{}}
+}
+
+func (m *MemoryIdempotencyStore) Reserve(ctx *Context, key string, lease time.Duration) (*IdempotentReply, error) {
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, k)
+		}
+	}
+	if entry, exists := m.entries[key]; exists {
+		if entry.reply == nil {
+			return nil, ErrInProgress
+		}
+		return entry.reply, nil
+	}
+	m.entries[key] = &idempotencyEntry{expires: now.Add(lease)}
+	return nil, nil
+}
+
+func (m *MemoryIdempotencyStore) Save(ctx *Context, key string, reply *IdempotentReply, window time.Duration) error {
+	m.mutex.Lock()
+	m.entries[key] = &idempotencyEntry{time.Now().Add(window), reply}
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(ctx *Context, key string) error {
+	m.mutex.Lock()
+	delete(m.entries, key)
+	m.mutex.Unlock()
+	return nil
+}
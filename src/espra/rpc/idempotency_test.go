@@ -0,0 +1,76 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func idempotentCall(ip, token, name string, arg int) ([]interface{}, *Error) {
+	ctx := NewContext(memoryBackend, "", nil)
+	ctx.Header["idempotency"] = token
+	ctx.ip = ip
+	raw := json.RawMessage(strconv.Itoa(arg))
+	reply, _, err := ctx.Call(name, []*json.RawMessage{&raw})
+	return reply, err
+}
+
+func TestIdempotent(t *testing.T) {
+
+	calls := 0
+	Register("idempotenttest.count", func(ctx *Context, n int) int {
+		calls++
+		return calls + n
+	}).Anon().Idempotent(time.Hour)
+
+	first, err := idempotentCall("1.2.3.4", "a", "idempotenttest.count", 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	replay, err := idempotentCall("1.2.3.4", "a", "idempotenttest.count", 10)
+	if err != nil || calls != 1 || string(replay[0].(json.RawMessage)) != strconv.Itoa(first[0].(int)) {
+		t.Fatalf("reply wasn't replayed: %v, %v", replay, err)
+	}
+	if _, err = idempotentCall("1.2.3.4", "a", "idempotenttest.count", 20); err != ErrKeyReused {
+		t.Fatalf("expected ErrKeyReused for different arguments, got %v", err)
+	}
+	if _, err = idempotentCall("5.6.7.8", "a", "idempotenttest.count", 10); err != nil || calls != 2 {
+		t.Fatalf("anonymous callers shared an idempotency key: %v", err)
+	}
+
+	release := make(chan struct{})
+	Register("idempotenttest.slow", func(ctx *Context, n int) int {
+		<-release
+		return n
+	}).Anon().Idempotent(time.Hour).Timeout(10 * time.Millisecond)
+
+	if _, err = idempotentCall("1.2.3.4", "b", "idempotenttest.slow", 1); err == nil || err.Code != Timeout {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if _, err = idempotentCall("1.2.3.4", "b", "idempotenttest.slow", 1); err != ErrInProgress {
+		t.Fatalf("expected the key to stay reserved after a timeout, got %v", err)
+	}
+	close(release)
+	var reply []interface{}
+	for i := 0; i < 100; i++ {
+		if reply, err = idempotentCall("1.2.3.4", "b", "idempotenttest.slow", 1); err != ErrInProgress {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil || string(reply[0].(json.RawMessage)) != "1" {
+		t.Fatalf("abandoned call's reply wasn't saved: %v, %v", reply, err)
+	}
+
+	store := NewMemoryIdempotencyStore()
+	store.Reserve(nil, "c", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if prev, err := store.Reserve(nil, "c", time.Hour); prev != nil || err != nil {
+		t.Fatalf("expected the key to be usable once its lease expired, got %v, %v", prev, err)
+	}
+
+}
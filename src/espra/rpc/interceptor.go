@@ -0,0 +1,89 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+// Handler represents a call to a service with decoded
+// arguments. Any trailing error value returned by the
+// service is split out from the other replies.
+type Handler func(ctx *Context, args []interface{}) ([]interface{}, error)
+
+// Interceptor wraps calls to services. It is given the name
+// of the service being called and can choose to inspect or
+// modify the args and replies, or to not call next at all.
+type Interceptor func(ctx *Context, name string, args []interface{}, next Handler) ([]interface{}, error)
+
+var (
+	interceptors   []Interceptor
+	nsInterceptors = map[string][]Interceptor{}
+)
+
+// Use adds interceptors which will wrap calls to all
+// services. Global interceptors run before those specified
+// for namespaces and individual services.
+func Use(i ...Interceptor) {
+	interceptors = append(interceptors, i...)
+}
+
+// Use adds interceptors which will wrap calls to all
+// services within the namespace, including those within
+// nested namespaces.
+func (ns Namespace) Use(i ...Interceptor) {
+	nsInterceptors[string(ns)] = append(nsInterceptors[string(ns)], i...)
+}
+
+func (s *service) With(i ...Interceptor) *service {
+	s.interceptors = append(s.interceptors, i...)
+	return s
+}
+
+func (s *service) call(ctx *Context, args []interface{}) ([]interface{}, error) {
+	in := make([]reflect.Value, len(args)+1)
+	in[0] = reflect.ValueOf(ctx)
+	for i, arg := range args {
+		if arg == nil {
+			in[i+1] = reflect.Zero(s.args[i])
+		} else {
+			in[i+1] = reflect.ValueOf(arg)
+		}
+	}
+	out := s.meth.Call(in)
+	var err error
+	if s.retErr {
+		err, _ = out[len(out)-1].Interface().(error)
+		out = out[:len(out)-1]
+	}
+	reply := make([]interface{}, len(out))
+	for i, v := range out {
+		reply[i] = v.Interface()
+	}
+	return reply, err
+}
+
+// handler returns the service call wrapped by the global,
+// namespace and service interceptors, with the outermost
+// interceptor being run first.
+func (s *service) handler(name string) Handler {
+	chain := append([]Interceptor{}, interceptors...)
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			chain = append(chain, nsInterceptors[name[:i]]...)
+		}
+	}
+	chain = append(chain, s.interceptors...)
+	h := Handler(s.call)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = intercept(chain[i], name, h)
+	}
+	return h
+}
+
+func intercept(i Interceptor, name string, next Handler) Handler {
+	return func(ctx *Context, args []interface{}) ([]interface{}, error) {
+		return i(ctx, name, args, next)
+	}
+}
@@ -0,0 +1,238 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The standard JSON-RPC 2.0 error codes. Errors raised by
+// services which don't map onto these are sent with the
+// generic server error code and have their native code in
+// the error data.
+const (
+	ParseErrorCode     = -32700
+	InvalidRequestCode = -32600
+	MethodNotFoundCode = -32601
+	InvalidParamsCode  = -32602
+	InternalErrorCode  = -32603
+	ServerErrorCode    = -32000
+)
+
+const jsonrpcVersion = "2.0"
+
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcResult struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcFailure struct {
+	Version string          `json:"jsonrpc"`
+	Error   *jsonrpcError   `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var nullID = json.RawMessage("null")
+
+func newJSONRPCFailure(id json.RawMessage, err *Error) *jsonrpcFailure {
+	if id == nil {
+		id = nullID
+	}
+	code := ServerErrorCode
+	switch err.Code {
+	case BadRequest:
+		code = InvalidParamsCode
+	case InternalError:
+		code = InternalErrorCode
+	case ServiceNotFound:
+		code = MethodNotFoundCode
+	}
+	data := map[string]interface{}{"code": err.Code}
+	if err.Data != nil {
+		data["data"] = err.Data
+	}
+	return &jsonrpcFailure{jsonrpcVersion, &jsonrpcError{code, err.Message, data}, id}
+}
+
+func writeJSONRPCError(w http.ResponseWriter, status, code int, message string) {
+	resp, _ := json.Marshal(&jsonrpcFailure{jsonrpcVersion, &jsonrpcError{Code: code, Message: message}, nullID})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// jsonrpcCall handles an individual JSON-RPC request object.
+// It returns nil for notifications.
+func (ctx *Context) jsonrpcCall(raw json.RawMessage) (resp interface{}) {
+
+	req := &jsonrpcRequest{}
+	if json.Unmarshal(raw, req) != nil || req.Version != jsonrpcVersion || req.Method == "" {
+		return &jsonrpcFailure{jsonrpcVersion, &jsonrpcError{Code: InvalidRequestCode, Message: "invalid request"}, nullID}
+	}
+
+	notification := req.ID == nil
+	defer func() {
+		if e := recover(); e != nil {
+			if _, yes := e.(redirect); yes {
+				e = NewError(BadRequest, "%s cannot redirect over JSON-RPC", ctx.meth)
+			}
+			err := ctx.recoverError(ctx.RequestID, e)
+			if notification {
+				resp = nil
+				return
+			}
+			resp = newJSONRPCFailure(req.ID, err)
+		}
+	}()
+
+	ctx.meth = req.Method
+	s := ctx.lookup(ctx.meth)
+
+	var params []*json.RawMessage
+	switch p := bytes.TrimSpace(req.Params); {
+	case len(p) == 0 || bytes.Equal(p, nullID):
+	case p[0] == '[':
+		if err := json.Unmarshal(p, &params); err != nil {
+			Raise(BadRequest, "invalid params for %s: %s", ctx.meth, err)
+		}
+	case p[0] == '{':
+		if s.in != 1 {
+			Raise(BadRequest, "%s doesn't support named params", ctx.meth)
+		}
+		obj := json.RawMessage(p)
+		params = []*json.RawMessage{&obj}
+	default:
+		Raise(BadRequest, "params for %s need to be an array or an object", ctx.meth)
+	}
+
+	reply := ctx.run(s, params)
+	if notification {
+		return nil
+	}
+
+	var result interface{}
+	switch len(reply) {
+	case 0:
+	case 1:
+		result = reply[0]
+	default:
+		result = reply
+	}
+
+	return &jsonrpcResult{jsonrpcVersion, result, req.ID}
+
+}
+
+// HandleJSONRPC serves the registered services over JSON-RPC
+// 2.0. Callers can authenticate by setting the HTTP
+// Authorization header to the value they would otherwise
+// send in the 'auth' header field of a native request.
+func HandleJSONRPC(w http.ResponseWriter, r *http.Request) {
+
+	id := newRequestID(r)
+	w.Header().Set("X-Request-Id", id)
+
+	if r.Method != "POST" {
+		writeJSONRPCError(w, http.StatusMethodNotAllowed, InvalidRequestCode, "required POST, received "+r.Method)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeJSONRPCError(w, http.StatusOK, ParseErrorCode, "couldn't read request body")
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	batch := len(body) > 0 && body[0] == '['
+
+	var calls []json.RawMessage
+	if batch {
+		if json.Unmarshal(body, &calls) != nil {
+			writeJSONRPCError(w, http.StatusOK, ParseErrorCode, "parse error")
+			return
+		}
+		if len(calls) == 0 {
+			writeJSONRPCError(w, http.StatusOK, InvalidRequestCode, "invalid request")
+			return
+		}
+	} else {
+		var v interface{}
+		if json.Unmarshal(body, &v) != nil {
+			writeJSONRPCError(w, http.StatusOK, ParseErrorCode, "parse error")
+			return
+		}
+		calls = []json.RawMessage{body}
+	}
+
+	ctx := getContext()
+	defer freeContext(ctx)
+
+	ctx.Backend = newBackend(r)
+	ctx.Header = make(Header)
+	ctx.ip = remoteIP(r)
+	ctx.RespHeader = make(Header)
+	ctx.RequestID = id
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx.Header["auth"] = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if version := r.Header.Get("X-Api-Version"); version != "" {
+		if n, err := strconv.Atoi(version); err == nil {
+			ctx.Header["version"] = n
+		} else {
+			ctx.Header["version"] = version
+		}
+	}
+
+	results := []interface{}{}
+	for _, call := range calls {
+		if res := ctx.jsonrpcCall(call); res != nil {
+			results = append(results, res)
+		}
+	}
+
+	warnings, _ := ctx.RespHeader["warnings"].([]string)
+	for _, warning := range warnings {
+		w.Header().Add("Warning", "299 - "+strconv.Quote(warning))
+	}
+
+	if len(results) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if batch {
+		err = ctx.enc.Encode(results)
+	} else {
+		err = ctx.enc.Encode(results[0])
+	}
+	if err != nil {
+		writeJSONRPCError(w, http.StatusOK, InternalErrorCode, "couldn't encode JSON response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ctx.buf.Bytes())
+
+}
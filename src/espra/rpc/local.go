@@ -0,0 +1,82 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// NewContext returns a Context for calling services in-process,
+// outside of an HTTP request, e.g. from tests. If a username is
+// given, it is used instead of resolving the 'auth' header
+// field. Similarly, non-nil scopes are used instead of calling
+// the scope resolver.
+func NewContext(backend Backend, username string, scopes []string) *Context {
+	ctx := &Context{
+		Backend:    backend,
+		Header:     Header{},
+		RespHeader: Header{},
+		RequestID:  newRequestID(nil),
+		req:        &request{},
+	}
+	if username != "" {
+		ctx.authDone = true
+		ctx.user = username
+	}
+	if scopes != nil {
+		ctx.scopes = scopes
+		ctx.scopesDone = true
+	}
+	return ctx
+}
+
+// Call invokes the named service with the JSON-encoded
+// arguments in the same way as Handle. If the service
+// redirects, the location is returned instead of a reply.
+func (ctx *Context) Call(name string, args []*json.RawMessage) (reply []interface{}, location string, err *Error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if redir, yes := e.(redirect); yes {
+				location = string(redir)
+			} else {
+				err = ctx.recoverError(ctx.RequestID, e)
+			}
+		}
+	}()
+	ctx.meth = name
+	reply = ctx.run(ctx.lookup(name), args)
+	return
+}
+
+// CallGet invokes the GET service identified by the path, e.g.
+// profile.gravatar/tav, in the same way as HandleGet. The raw
+// replies of the service are returned.
+func (ctx *Context) CallGet(path string, query url.Values) (reply []interface{}, location string, err *Error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if redir, yes := e.(redirect); yes {
+				location = string(redir)
+			} else {
+				err = ctx.recoverError(ctx.RequestID, e)
+			}
+		}
+	}()
+	call := strings.Split(path, "/")
+	name := call[0]
+	s, exists := getServices[name]
+	if !exists {
+		Raise(ServiceNotFound, "service not found: %s", name)
+	}
+	if len(call)-1 > s.in {
+		Raise(BadRequest, "too many arguments for %s", name)
+	}
+	ctx.meth = name
+	args := s.getArgs(call[1:], query)
+	ctx.Username = ""
+	ctx.checkLimits(s)
+	reply = ctx.invoke(s, args)
+	return
+}
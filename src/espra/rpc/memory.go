@@ -0,0 +1,512 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntity struct {
+	key   *Key
+	props map[string]reflect.Value
+}
+
+// MemoryBackend is a Backend which keeps entities in memory.
+// Entities are stored as copies of their properties, named by
+// their datastore struct tags, so they can be loaded into any
+// struct type with compatible fields. It is safe for
+// concurrent use.
+type MemoryBackend struct {
+	entities map[string]*memoryEntity
+	mutex    sync.RWMutex
+	nextID   int64
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{entities: map[string]*memoryEntity{}}
+}
+
+func (m *MemoryBackend) logf(level, format string, args ...interface{}) {
+	log.Printf(level+": "+format, args...)
+}
+
+func (m *MemoryBackend) Debugf(format string, args ...interface{}) {
+	m.logf("DEBUG", format, args...)
+}
+
+func (m *MemoryBackend) Infof(format string, args ...interface{}) {
+	m.logf("INFO", format, args...)
+}
+
+func (m *MemoryBackend) Warningf(format string, args ...interface{}) {
+	m.logf("WARNING", format, args...)
+}
+
+func (m *MemoryBackend) Errorf(format string, args ...interface{}) {
+	m.logf("ERROR", format, args...)
+}
+
+func (m *MemoryBackend) Criticalf(format string, args ...interface{}) {
+	m.logf("CRITICAL", format, args...)
+}
+
+func (m *MemoryBackend) Delete(key *Key) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.delete(key)
+}
+
+func (m *MemoryBackend) Get(key *Key, dst interface{}) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.get(key, dst)
+}
+
+func (m *MemoryBackend) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getAll(q, dst)
+}
+
+func (m *MemoryBackend) Put(key *Key, src interface{}) (*Key, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.put(key, src)
+}
+
+// RunInTransaction runs f with exclusive access to the
+// backend. Any changes made within f are rolled back if it
+// returns an error. The backend needs to be accessed via the
+// Backend passed to f, as its own methods would block until
+// the transaction has finished.
+func (m *MemoryBackend) RunInTransaction(f func(tx Backend) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	saved := make(map[string]*memoryEntity, len(m.entities))
+	for k, entity := range m.entities {
+		saved[k] = entity
+	}
+	if err := f(memoryTx{m}); err != nil {
+		m.entities = saved
+		return err
+	}
+	return nil
+}
+
+// WithDeadline returns the backend itself, as its operations
+// complete without blocking.
+func (m *MemoryBackend) WithDeadline(deadline time.Time) Backend {
+	return m
+}
+
+func (m *MemoryBackend) delete(key *Key) error {
+	delete(m.entities, key.String())
+	return nil
+}
+
+func (m *MemoryBackend) get(key *Key, dst interface{}) error {
+	entity, exists := m.entities[key.String()]
+	if !exists {
+		return ErrNoSuchEntity
+	}
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: invalid entity type: %T", dst)
+	}
+	return loadProps(rv.Elem(), entity.props)
+}
+
+func (m *MemoryBackend) getAll(q *Query, dst interface{}) ([]*Key, error) {
+	var slice reflect.Value
+	if !q.KeysOnly {
+		rv := reflect.ValueOf(dst)
+		if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+			return nil, fmt.Errorf("rpc: invalid query destination type: %T", dst)
+		}
+		slice = rv.Elem()
+	}
+	results := []*memoryEntity{}
+	for _, entity := range m.entities {
+		if entity.key.kind != q.Kind {
+			continue
+		}
+		if q.Ancestor != nil && !entity.key.HasAncestor(q.Ancestor) {
+			continue
+		}
+		if matchFilters(entity, q.Filters) {
+			results = append(results, entity)
+		}
+	}
+	sort.Sort(&entitySorter{results, q.Orders})
+	if q.Offset > 0 {
+		if q.Offset > len(results) {
+			results = nil
+		} else {
+			results = results[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(results) {
+		results = results[:q.Limit]
+	}
+	keys := make([]*Key, len(results))
+	for i, entity := range results {
+		keys[i] = entity.key
+		if q.KeysOnly {
+			continue
+		}
+		elemType := slice.Type().Elem()
+		isPtr := elemType.Kind() == reflect.Ptr
+		if isPtr {
+			elemType = elemType.Elem()
+		}
+		if elemType.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("rpc: invalid query destination type: %T", dst)
+		}
+		elem := reflect.New(elemType)
+		if err := loadProps(elem.Elem(), entity.props); err != nil {
+			return nil, err
+		}
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return keys, nil
+}
+
+func (m *MemoryBackend) put(key *Key, src interface{}) (*Key, error) {
+	rv := reflect.ValueOf(src)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("rpc: invalid entity type: %T", src)
+	}
+	// IDs are allocated above any that have been used explicitly,
+	// so that entities aren't overwritten by later allocations.
+	if key.Incomplete() {
+		m.nextID += 1
+		key = NewKey(key.kind, "", m.nextID, key.parent)
+	} else if key.intID > m.nextID {
+		m.nextID = key.intID
+	}
+	m.entities[key.String()] = &memoryEntity{key, saveProps(rv)}
+	return key, nil
+}
+
+// memoryTx is the Backend passed to transactions on a
+// MemoryBackend. Its operations rely on the lock held by
+// RunInTransaction.
+type memoryTx struct {
+	*MemoryBackend
+}
+
+func (t memoryTx) Delete(key *Key) error {
+	return t.delete(key)
+}
+
+func (t memoryTx) Get(key *Key, dst interface{}) error {
+	return t.get(key, dst)
+}
+
+func (t memoryTx) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	return t.getAll(q, dst)
+}
+
+func (t memoryTx) Put(key *Key, src interface{}) (*Key, error) {
+	return t.put(key, src)
+}
+
+func (t memoryTx) RunInTransaction(f func(tx Backend) error) error {
+	return ErrNestedTransaction
+}
+
+func (t memoryTx) WithDeadline(deadline time.Time) Backend {
+	return t
+}
+
+func propName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return "-"
+	}
+	name := strings.Split(field.Tag.Get("datastore"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func saveProps(rv reflect.Value) map[string]reflect.Value {
+	props := map[string]reflect.Value{}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if name := propName(rt.Field(i)); name != "-" {
+			props[name] = copyValue(rv.Field(i))
+		}
+	}
+	return props
+}
+
+func loadProps(rv reflect.Value, props map[string]reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name := propName(field)
+		if name == "-" {
+			continue
+		}
+		prop, exists := props[name]
+		if !exists {
+			continue
+		}
+		switch {
+		case prop.Type().AssignableTo(field.Type):
+			rv.Field(i).Set(copyValue(prop))
+		case prop.Kind() == field.Type.Kind() && prop.Type().ConvertibleTo(field.Type):
+			rv.Field(i).Set(copyValue(prop).Convert(field.Type))
+		default:
+			return fmt.Errorf("rpc: cannot load the %q property of type %s into a field of type %s", name, prop.Type(), field.Type)
+		}
+	}
+	return nil
+}
+
+// copyValue returns a deep copy of the given value so that
+// stored entities can't be modified via aliased slices, maps
+// or pointers.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(v.Type()).Elem()
+		n.Set(copyValue(v.Elem()))
+		return n
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			n.SetMapIndex(key, copyValue(v.MapIndex(key)))
+		}
+		return n
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(v.Type().Elem())
+		n.Elem().Set(copyValue(v.Elem()))
+		return n
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			n.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return n
+	case reflect.Struct:
+		n := reflect.New(v.Type()).Elem()
+		n.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := n.Field(i); f.CanSet() {
+				f.Set(copyValue(v.Field(i)))
+			}
+		}
+		return n
+	}
+	return v
+}
+
+var keyType = reflect.TypeOf(&Key{})
+
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.Type() != keyType {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// compare returns -1, 0 or 1 depending on whether a is less
+// than, equal to or greater than b. The second return value is
+// false if the values can't be compared.
+func compare(a, b reflect.Value) (int, bool) {
+	var ok1, ok2 bool
+	a, ok1 = indirect(a)
+	b, ok2 = indirect(b)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	if x, ok := a.Interface().(*Key); ok {
+		y, ok := b.Interface().(*Key)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(x.String(), y.String()), true
+	}
+	if a.Type() == timeType || b.Type() == timeType {
+		x, ok1 := a.Interface().(time.Time)
+		y, ok2 := b.Interface().(time.Time)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch a.Kind() {
+	case reflect.Bool:
+		if b.Kind() != reflect.Bool {
+			return 0, false
+		}
+		x, y := a.Bool(), b.Bool()
+		switch {
+		case x == y:
+			return 0, true
+		case y:
+			return -1, true
+		}
+		return 1, true
+	case reflect.String:
+		if b.Kind() != reflect.String {
+			return 0, false
+		}
+		return compareStrings(a.String(), b.String()), true
+	case reflect.Slice:
+		if a.Type().Elem().Kind() == reflect.Uint8 && b.Kind() == reflect.Slice && b.Type().Elem().Kind() == reflect.Uint8 {
+			return compareStrings(string(a.Bytes()), string(b.Bytes())), true
+		}
+	}
+	return 0, false
+}
+
+func compareStrings(x, y string) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// isMulti returns whether the property holds multiple values,
+// where []byte values are treated as a single value.
+func isMulti(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8
+}
+
+func matchFilter(prop reflect.Value, f Filter) bool {
+	if isMulti(prop) {
+		for i := 0; i < prop.Len(); i++ {
+			if matchFilter(prop.Index(i), f) {
+				return true
+			}
+		}
+		return false
+	}
+	cmp, ok := compare(prop, reflect.ValueOf(f.Value))
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func matchFilters(entity *memoryEntity, filters []Filter) bool {
+	for _, f := range filters {
+		prop, exists := entity.props[f.Property]
+		if !exists || !matchFilter(prop, f) {
+			return false
+		}
+	}
+	return true
+}
+
+type entitySorter struct {
+	entities []*memoryEntity
+	orders   []string
+}
+
+func (s *entitySorter) Len() int {
+	return len(s.entities)
+}
+
+func (s *entitySorter) Less(i, j int) bool {
+	a, b := s.entities[i], s.entities[j]
+	for _, order := range s.orders {
+		desc := strings.HasPrefix(order, "-")
+		if desc {
+			order = order[1:]
+		}
+		x, ok1 := a.props[order]
+		y, ok2 := b.props[order]
+		if !ok1 || !ok2 {
+			continue
+		}
+		if cmp, ok := compare(x, y); ok && cmp != 0 {
+			if desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+	}
+	return compareStrings(a.key.String(), b.key.String()) < 0
+}
+
+func (s *entitySorter) Swap(i, j int) {
+	s.entities[i], s.entities[j] = s.entities[j], s.entities[i]
+}
@@ -0,0 +1,76 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"testing"
+)
+
+type testEntity struct {
+	Name  string   `datastore:"n"`
+	Score int      `datastore:"s"`
+	Tags  []string `datastore:"t"`
+}
+
+func TestMemoryBackend(t *testing.T) {
+
+	m := NewMemoryBackend()
+	parent := NewKey("U", "tav", 0, nil)
+
+	key, err := m.Put(NewKey("I", "", 0, parent), &testEntity{"first", 10, []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("unexpected error on put: %s", err)
+	}
+	if key.Incomplete() || !key.Parent().Equal(parent) {
+		t.Fatalf("got an invalid key from put: %s", key)
+	}
+
+	m.Put(NewKey("I", "", 0, parent), &testEntity{"second", 30, []string{"b"}})
+	m.Put(NewKey("I", "", 0, NewKey("U", "olly", 0, nil)), &testEntity{"third", 20, nil})
+
+	entity := &testEntity{}
+	if err = m.Get(key, entity); err != nil {
+		t.Fatalf("unexpected error on get: %s", err)
+	}
+	if entity.Name != "first" || entity.Score != 10 || len(entity.Tags) != 2 {
+		t.Errorf("got unexpected entity: %#v", entity)
+	}
+
+	entity.Tags[0] = "modified"
+	check := &testEntity{}
+	m.Get(key, check)
+	if check.Tags[0] != "a" {
+		t.Errorf("stored entity was modified via an aliased slice")
+	}
+
+	var results []*testEntity
+	keys, err := m.GetAll(NewQuery("I").Filter("s >=", 15).Order("-s"), &results)
+	if err != nil {
+		t.Fatalf("unexpected error on query: %s", err)
+	}
+	if len(keys) != 2 || results[0].Name != "second" || results[1].Name != "third" {
+		t.Errorf("got unexpected query results: %v", results)
+	}
+
+	results = nil
+	m.GetAll(&Query{Kind: "I", Ancestor: parent, Filters: []Filter{{"t", "=", "b"}}}, &results)
+	if len(results) != 2 {
+		t.Errorf("expected 2 results for the ancestor query, got %d", len(results))
+	}
+
+	m.Delete(key)
+	if err = m.Get(key, entity); err != ErrNoSuchEntity {
+		t.Errorf("expected ErrNoSuchEntity for a deleted entity, got %v", err)
+	}
+
+	m = NewMemoryBackend()
+	explicit := NewKey("X", "", 1, nil)
+	m.Put(explicit, &testEntity{Name: "explicit"})
+	allocated, _ := m.Put(NewKey("X", "", 0, nil), &testEntity{Name: "allocated"})
+	m.Get(explicit, entity)
+	if allocated.Equal(explicit) || entity.Name != "explicit" {
+		t.Errorf("allocated key %s overwrote an explicitly keyed entity", allocated)
+	}
+
+}
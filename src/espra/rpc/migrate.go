@@ -0,0 +1,218 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Upgrade migrates an entity from one schema version to the
+// next. The entity is a pointer to the struct type registered
+// for its kind.
+type Upgrade func(ctx *Context, key *Key, entity interface{}) error
+
+// EntitySchema holds the upgrades for the entities of a kind.
+// An entity's schema version is held in the int Version field
+// of its struct, with version 0 denoting entities which
+// predate any upgrades.
+type EntitySchema struct {
+	field    int
+	kind     string
+	prop     string
+	typ      reflect.Type
+	upgrades []Upgrade
+}
+
+var schemas = map[string]*EntitySchema{}
+
+// RegisterSchema registers the struct type used for entities
+// of the given kind so that they can be upgraded as they're
+// loaded. It panics if the struct doesn't have an int Version
+// field.
+func RegisterSchema(kind string, entity interface{}) *EntitySchema {
+	if _, exists := schemas[kind]; exists {
+		panic(fmt.Errorf("rpc: the schema for %s has already been registered", kind))
+	}
+	typ := reflect.TypeOf(entity)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		panic(fmt.Errorf("rpc: the schema for %s needs to be a struct, not %s", kind, typ))
+	}
+	field, ok := typ.FieldByName("Version")
+	if !ok || field.Type.Kind() != reflect.Int || len(field.Index) != 1 {
+		panic(fmt.Errorf("rpc: the schema for %s needs an int Version field", kind))
+	}
+	s := &EntitySchema{field: field.Index[0], kind: kind, prop: propName(field), typ: typ}
+	schemas[kind] = s
+	return s
+}
+
+// Upgrade adds the function for upgrading entities from the
+// given version to the next one. Upgrades need to be added in
+// order, starting from version 0.
+func (s *EntitySchema) Upgrade(from int, fn Upgrade) *EntitySchema {
+	if from != len(s.upgrades) {
+		panic(fmt.Errorf("rpc: expected the upgrade from version %d of %s, got one from version %d", len(s.upgrades), s.kind, from))
+	}
+	s.upgrades = append(s.upgrades, fn)
+	return s
+}
+
+// Version returns the latest schema version for the kind.
+func (s *EntitySchema) Version() int {
+	return len(s.upgrades)
+}
+
+// schemaFor returns the schema for the kind if the value is a
+// pointer to its registered struct type.
+func schemaFor(kind string, v reflect.Value) *EntitySchema {
+	s, exists := schemas[kind]
+	if !exists || v.Kind() != reflect.Ptr || v.Type().Elem() != s.typ || v.IsNil() {
+		return nil
+	}
+	return s
+}
+
+// upgrade applies any outstanding upgrades to the entity and
+// returns whether it was modified.
+func (ctx *Context) upgrade(s *EntitySchema, key *Key, entity reflect.Value) (bool, error) {
+	field := entity.Elem().Field(s.field)
+	version := int(field.Int())
+	if version >= len(s.upgrades) {
+		return false, nil
+	}
+	for ; version < len(s.upgrades); version++ {
+		if err := s.upgrades[version](ctx, key, entity.Interface()); err != nil {
+			return false, fmt.Errorf("rpc: couldn't upgrade %s from version %d: %s", key, version, err)
+		}
+		field.SetInt(int64(version + 1))
+	}
+	return true, nil
+}
+
+// migrate upgrades a loaded entity and writes it back, so that
+// entities are lazily migrated as they're used. Failures to
+// write back are only logged, as the upgrade will be retried
+// on the next load. Entities loaded within a transaction are
+// only upgraded in memory.
+func (ctx *Context) migrate(key *Key, entity reflect.Value) error {
+	s := schemaFor(key.Kind(), entity)
+	if s == nil {
+		return nil
+	}
+	changed, err := ctx.upgrade(s, key, entity)
+	if err != nil || !changed || ctx.tx {
+		return err
+	}
+	if _, err := ctx.writeBack(s, key); err != nil {
+		ctx.Backend.Warningf("rpc: couldn't save the upgraded %s: %s", key, err)
+	}
+	return nil
+}
+
+// writeBack upgrades and saves the stored entity within a
+// transaction, so that any writes made since it was loaded
+// aren't overwritten. Nothing is saved if the entity has since
+// been deleted or is already at the latest version. It returns
+// whether the entity was saved.
+func (ctx *Context) writeBack(s *EntitySchema, key *Key) (saved bool, err error) {
+	err = ctx.Backend.RunInTransaction(func(tx Backend) error {
+		saved = false
+		entity := reflect.New(s.typ)
+		if err := tx.Get(key, entity.Interface()); err != nil {
+			if err == ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		changed, err := ctx.inTransaction(tx).upgrade(s, key, entity)
+		if err != nil || !changed {
+			return err
+		}
+		if _, err = tx.Put(key, entity.Interface()); err != nil {
+			return err
+		}
+		saved = true
+		return nil
+	})
+	return
+}
+
+// stampVersion sets the Version of new entities to the latest
+// for their kind. Only entities with incomplete keys are known
+// to be new, so entities put under complete keys carry the
+// Version they were loaded with, and new ones need to set it
+// from EntitySchema.Version themselves.
+func (ctx *Context) stampVersion(key *Key, src interface{}) {
+	if !key.Incomplete() {
+		return
+	}
+	entity := reflect.ValueOf(src)
+	if s := schemaFor(key.Kind(), entity); s != nil {
+		field := entity.Elem().Field(s.field)
+		if field.Int() == 0 {
+			field.SetInt(int64(len(s.upgrades)))
+		}
+	}
+}
+
+// BackfillProgress tracks the migration of all entities of a
+// kind to the latest schema version.
+type BackfillProgress struct {
+	Done     bool      `datastore:"d,noindex" json:"done"`
+	Error    string    `datastore:"e,noindex" json:"error,omitempty"`
+	Kind     string    `datastore:"k,noindex" json:"kind"`
+	Migrated int       `datastore:"m,noindex" json:"migrated"`
+	Started  time.Time `datastore:"s,noindex" json:"started"`
+	Updated  time.Time `datastore:"u,noindex" json:"updated"`
+	Version  int       `datastore:"v,noindex" json:"version"`
+}
+
+// Backfill upgrades up to limit entities of the kind which are
+// at older schema versions and updates the progress. Each
+// entity is upgraded within its own transaction. It is
+// meant to be called repeatedly, e.g. from a task queue, until
+// the progress is Done. Upgrade errors are recorded on the
+// progress as well as being returned.
+func (ctx *Context) Backfill(p *BackfillProgress, limit int) error {
+	s, exists := schemas[p.Kind]
+	if !exists {
+		return fmt.Errorf("rpc: no schema has been registered for %s", p.Kind)
+	}
+	now := time.Now().UTC()
+	if p.Started.IsZero() {
+		p.Started = now
+	}
+	p.Updated = now
+	p.Version = s.Version()
+	q := NewQuery(p.Kind).Filter(s.prop+" <", p.Version)
+	q.KeysOnly = true
+	q.Limit = limit
+	keys, err := ctx.Backend.GetAll(q, nil)
+	if err == nil {
+		for _, key := range keys {
+			var saved bool
+			if saved, err = ctx.writeBack(s, key); err != nil {
+				break
+			}
+			if saved {
+				p.Migrated++
+			}
+		}
+	}
+	if err != nil {
+		p.Error = err.Error()
+		return err
+	}
+	p.Error = ""
+	if len(keys) < limit {
+		p.Done = true
+	}
+	ctx.Backend.Infof("rpc: backfilled %d entities of %s to version %d so far", p.Migrated, p.Kind, p.Version)
+	return nil
+}
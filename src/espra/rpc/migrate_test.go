@@ -0,0 +1,93 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type migrateEntity struct {
+	Name    string `datastore:"n"`
+	Version int    `datastore:"v"`
+}
+
+func init() {
+	RegisterSchema("MT", &migrateEntity{}).
+		Upgrade(0, func(ctx *Context, key *Key, entity interface{}) error {
+			e := entity.(*migrateEntity)
+			e.Name = strings.TrimSpace(e.Name)
+			return nil
+		}).
+		Upgrade(1, func(ctx *Context, key *Key, entity interface{}) error {
+			e := entity.(*migrateEntity)
+			e.Name = strings.ToLower(e.Name)
+			return nil
+		})
+}
+
+func TestMigrate(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	ctx := NewContext(backend, "", nil)
+
+	key, _ := backend.Put(NewKey("MT", "", 0, nil), &migrateEntity{Name: " Tav "})
+	for i := 0; i < 4; i++ {
+		backend.Put(NewKey("MT", "", 0, nil), &migrateEntity{Name: " Old ", Version: 1})
+	}
+
+	entity := &migrateEntity{}
+	if err := ctx.Get(key, entity); err != nil {
+		t.Fatalf("unexpected error on get: %s", err)
+	}
+	if entity.Name != "tav" || entity.Version != 2 {
+		t.Fatalf("entity wasn't upgraded on load: %#v", entity)
+	}
+	stored := &migrateEntity{}
+	backend.Get(key, stored)
+	if stored.Version != 2 {
+		t.Fatalf("upgraded entity wasn't saved: %#v", stored)
+	}
+
+	created := &migrateEntity{Name: "new"}
+	ctx.Put(NewKey("MT", "", 0, nil), created)
+	if created.Version != 2 {
+		t.Fatalf("new entity wasn't put at the latest version: %#v", created)
+	}
+
+	existing := NewKey("MT", "existing", 0, nil)
+	backend.Put(existing, &migrateEntity{Name: " Stale "})
+	stale := &migrateEntity{}
+	backend.Get(existing, stale)
+	ctx.Put(existing, &migrateEntity{Name: " Fresh "})
+	if err := backend.Get(existing, stored); err != nil || stored.Version != 0 {
+		t.Fatalf("existing entity was put at the latest version: %#v", stored)
+	}
+	ctx.migrate(existing, reflect.ValueOf(stale))
+	backend.Get(existing, stored)
+	if stored.Name != "fresh" || stored.Version != 2 {
+		t.Fatalf("upgrade overwrote a newer write: %#v", stored)
+	}
+
+	p := &BackfillProgress{Kind: "MT"}
+	for i := 0; !p.Done; i++ {
+		if i == 5 {
+			t.Fatalf("backfill didn't finish: %#v", p)
+		}
+		if err := ctx.Backfill(p, 3); err != nil {
+			t.Fatalf("unexpected error on backfill: %s", err)
+		}
+	}
+	if p.Migrated != 4 || p.Version != 2 {
+		t.Fatalf("got unexpected backfill progress: %#v", p)
+	}
+
+	list := []*migrateEntity{}
+	ctx.GetAll(NewQuery("MT").Filter("v <", 2), &list)
+	if len(list) != 0 {
+		t.Fatalf("found %d entities which weren't backfilled", len(list))
+	}
+
+}
@@ -0,0 +1,85 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"espra/msgpack"
+	"net/http"
+	"strings"
+)
+
+// MsgpackType is the content type which clients can use to
+// send requests, and receive responses, encoded as MessagePack
+// instead of JSON. Arguments and replies are decoded and
+// encoded directly, with the same field names as JSON, and
+// []byte values are sent as binary rather than base64.
+const MsgpackType = "application/msgpack"
+
+type msgpackRequest struct {
+	Header Header                  `json:"header"`
+	Call   []*msgpack.RawMessage   `json:"call"`
+	Batch  [][]*msgpack.RawMessage `json:"batch"`
+}
+
+// decodeMsgpack decodes the envelope of a MessagePack request.
+// The raw elements of each call are kept as they are in req,
+// and are decoded by ctx.unmarshal once the Context has been
+// marked as binary.
+func decodeMsgpack(data []byte, req *request) error {
+	env := &msgpackRequest{}
+	if err := msgpack.Unmarshal(data, env); err != nil {
+		return err
+	}
+	req.Header = env.Header
+	req.Call = rawCall(env.Call)
+	if env.Batch != nil {
+		req.Batch = make([][]*json.RawMessage, len(env.Batch))
+		for i, call := range env.Batch {
+			req.Batch[i] = rawCall(call)
+		}
+	}
+	return nil
+}
+
+func rawCall(call []*msgpack.RawMessage) []*json.RawMessage {
+	if call == nil {
+		return nil
+	}
+	raw := make([]*json.RawMessage, len(call))
+	for i, elem := range call {
+		if elem != nil {
+			msg := json.RawMessage(*elem)
+			raw[i] = &msg
+		}
+	}
+	return raw
+}
+
+func (ctx *Context) unmarshal(data []byte, v interface{}) error {
+	if ctx.binary {
+		return msgpack.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func isMsgpack(contentType string) bool {
+	if idx := strings.Index(contentType, ";"); idx != -1 {
+		contentType = contentType[:idx]
+	}
+	switch strings.ToLower(strings.TrimSpace(contentType)) {
+	case MsgpackType, "application/x-msgpack":
+		return true
+	}
+	return false
+}
+
+func writeMsgpackError(w http.ResponseWriter, hdr Header, err *Error) {
+	resp, e := msgpack.Marshal(&errorResponse{hdr, err})
+	if e != nil {
+		writeError(w, hdr, err)
+		return
+	}
+	sendError(w, MsgpackType, resp, err)
+}
@@ -0,0 +1,58 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"bytes"
+	"espra/msgpack"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type msgpackBlob struct {
+	Data []byte `json:"data"`
+	Name string `json:"name"`
+}
+
+func TestMsgpack(t *testing.T) {
+
+	Register("msgpacktest.echo", func(ctx *Context, blob *msgpackBlob, n int) (*msgpackBlob, int) {
+		blob.Data = append(blob.Data, '!')
+		return blob, n + 1
+	}).Anon()
+
+	body, err := msgpack.Marshal(map[string]interface{}{
+		"call": []interface{}{"msgpacktest.echo", &msgpackBlob{[]byte{0xff, 0x00}, "tav"}, 41},
+	})
+	if err != nil {
+		t.Fatalf("couldn't encode request: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/.rpc", bytes.NewReader(body))
+	r.Header.Set("Content-Type", MsgpackType)
+	Handle(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != MsgpackType {
+		t.Fatalf("got content type %q: %s", ct, w.Body.Bytes())
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte{0xc4, 0x03, 0xff, 0x00, '!'}) {
+		t.Errorf("[]byte reply not encoded as binary: % x", w.Body.Bytes())
+	}
+	resp := &struct {
+		Reply []msgpack.RawMessage `json:"reply"`
+	}{}
+	if err := msgpack.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("couldn't decode response: %s", err)
+	}
+	blob, n := &msgpackBlob{}, 0
+	if len(resp.Reply) != 2 || msgpack.Unmarshal(resp.Reply[0], blob) != nil || msgpack.Unmarshal(resp.Reply[1], &n) != nil {
+		t.Fatalf("got unexpected reply: % x", w.Body.Bytes())
+	}
+	if string(blob.Data) != "\xff\x00!" || blob.Name != "tav" || n != 42 {
+		t.Errorf("got unexpected reply values: %#v, %d", blob, n)
+	}
+
+}
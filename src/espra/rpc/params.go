@@ -0,0 +1,135 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type param struct {
+	name  string
+	value interface{}
+}
+
+// Params names the parameters of a GET service so that they
+// can also be specified within the query string. A default
+// value can be given for a parameter by using the name=value
+// form, e.g.
+//
+//	rpc.RegisterGet("profile.gravatar", Gravatar).Params("username", "size=150")
+//
+// Path segments take precedence over query parameters, which
+// in turn take precedence over defaults. Parameters which
+// aren't specified anywhere are set to their zero value.
+func (s *service) Params(specs ...string) *service {
+	if len(specs) > s.in {
+		panic(fmt.Sprintf("rpc: too many params specified for a service that takes %d arguments", s.in))
+	}
+	s.params = make([]*param, len(specs))
+	for i, spec := range specs {
+		p := &param{name: spec}
+		if idx := strings.Index(spec, "="); idx != -1 {
+			p.name = spec[:idx]
+			v, err := parseParam(s.args[i], spec[idx+1:])
+			if err != nil {
+				panic(fmt.Sprintf("rpc: invalid default value for the `%s` param: %s", p.name, err))
+			}
+			p.value = v
+		}
+		s.params[i] = p
+	}
+	return s
+}
+
+func isParamType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func parseParam(t reflect.Type, value string) (interface{}, error) {
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		rv.SetBool(v)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(value, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		rv.SetFloat(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(value, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		rv.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(value, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		rv.SetUint(v)
+	case reflect.String:
+		rv.SetString(value)
+	default:
+		return nil, fmt.Errorf("unsupported parameter type: %s", t)
+	}
+	return rv.Interface(), nil
+}
+
+// getArgs converts the path segments and query parameters of
+// a GET request into the typed arguments for the service.
+func (s *service) getArgs(segments []string, query url.Values) []interface{} {
+	args := make([]interface{}, s.in)
+	for i, typ := range s.args {
+		var p *param
+		if i < len(s.params) {
+			p = s.params[i]
+		}
+		value := ""
+		if i < len(segments) {
+			value = segments[i]
+		}
+		if value == "" && p != nil {
+			value = query.Get(p.name)
+		}
+		if value == "" {
+			if p != nil && p.value != nil {
+				args[i] = p.value
+			} else {
+				args[i] = reflect.Zero(typ).Interface()
+			}
+			continue
+		}
+		v, err := parseParam(typ, value)
+		if err != nil {
+			name := strconv.Itoa(i + 1)
+			if p != nil {
+				name = p.name
+			}
+			panic(&Error{
+				Code:    BadRequest,
+				Message: fmt.Sprintf("invalid value for the '%s' parameter: %q", name, value),
+				Data:    map[string]string{"param": name},
+			})
+		}
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,167 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket which holds up to Burst
+// tokens and is refilled at the rate of Rate tokens every Per.
+// Each call takes a single token from the bucket.
+type Limit struct {
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+func newLimit(rate int, per time.Duration) *Limit {
+	if rate <= 0 || per <= 0 {
+		panic("rpc: rate limits need a positive rate and period")
+	}
+	return &Limit{Rate: rate, Per: per, Burst: rate}
+}
+
+// RateLimitStore holds the state of rate limit buckets. Take
+// removes a token from the bucket identified by the key. If
+// the bucket is empty, it returns how long it will be until
+// the next token is available.
+type RateLimitStore interface {
+	Take(ctx *Context, key string, limit *Limit) (wait time.Duration, err error)
+}
+
+// RetryInfo is sent as the data of rate limit errors.
+type RetryInfo struct {
+	RetryAfter int `json:"retry_after"`
+}
+
+var (
+	nsLimits                      = map[string]*Limit{}
+	rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+)
+
+// SetRateLimitStore sets the store used for the state of rate
+// limit buckets. By default, it is kept in memory.
+func SetRateLimitStore(store RateLimitStore) {
+	rateLimitStore = store
+}
+
+// RateLimit limits each caller to rate calls of the service
+// every period. Callers are identified by their username, or
+// by their IP address for anonymous services.
+func (s *service) RateLimit(rate int, per time.Duration) *service {
+	s.limit = newLimit(rate, per)
+	return s
+}
+
+// RateLimit limits each caller to rate calls every period
+// across all of the services within the namespace, including
+// those within nested namespaces.
+func (ns Namespace) RateLimit(rate int, per time.Duration) {
+	nsLimits[string(ns)] = newLimit(rate, per)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLimits takes a token from the namespace and service
+// buckets for the caller and raises a rate limit error if any
+// of them are empty.
+func (ctx *Context) checkLimits(s *service) {
+	caller := "ip:" + ctx.ip
+	if ctx.Username != "" {
+		caller = "user:" + ctx.Username
+	}
+	name := ctx.meth
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			if limit, ok := nsLimits[name[:i]]; ok {
+				ctx.takeToken("ratelimit:ns:"+name[:i]+":"+caller, limit)
+			}
+		}
+	}
+	if s.limit != nil {
+		ctx.takeToken("ratelimit:service:"+name+":"+caller, s.limit)
+	}
+}
+
+func (ctx *Context) takeToken(key string, limit *Limit) {
+	wait, err := rateLimitStore.Take(ctx, key, limit)
+	if err != nil {
+		ctx.Backend.Errorf("rpc: couldn't check rate limit for %s: %s", ctx.meth, err)
+		return
+	}
+	if wait <= 0 {
+		return
+	}
+	secs := int(math.Ceil(wait.Seconds()))
+	if ctx.RespHeader != nil {
+		ctx.RespHeader["retry_after"] = secs
+	}
+	panic(&Error{
+		Code:    RateLimited,
+		Message: "rate limit exceeded for " + ctx.meth,
+		Data:    &RetryInfo{secs},
+	})
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore which keeps bucket
+// state in memory and is only suitable for single instances
+// and tests.
+type MemoryRateLimitStore struct {
+	buckets map[string]*bucket
+	mutex   sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (m *MemoryRateLimitStore) Take(ctx *Context, key string, limit *Limit) (time.Duration, error) {
+	now := time.Now()
+	rate := float64(limit.Rate) / float64(limit.Per)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	b, exists := m.buckets[key]
+	if !exists {
+		if len(m.buckets) >= 10000 {
+			m.expire(now)
+		}
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(now.Sub(b.updated))*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate), nil
+	}
+	b.tokens -= 1
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / rate))
+	return 0, nil
+}
+
+// expire removes the buckets which would have been refilled by
+// now, as they're equivalent to new ones.
+func (m *MemoryRateLimitStore) expire(now time.Time) {
+	for key, b := range m.buckets {
+		if now.After(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	m := NewMemoryRateLimitStore()
+	limit := &Limit{Rate: 2, Per: time.Hour, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if wait, _ := m.Take(nil, "tav", limit); wait != 0 {
+			t.Fatalf("got wait of %s for call %d", wait, i+1)
+		}
+	}
+	wait, _ := m.Take(nil, "tav", limit)
+	if wait <= 0 || wait > 30*time.Minute {
+		t.Fatalf("got unexpected wait for empty bucket: %s", wait)
+	}
+	if wait, _ := m.Take(nil, "alice", limit); wait != 0 {
+		t.Fatalf("buckets for different keys aren't independent")
+	}
+	m.buckets["tav"].updated = time.Now().Add(-time.Hour)
+	if wait, _ := m.Take(nil, "tav", limit); wait != 0 {
+		t.Fatalf("bucket wasn't refilled: got wait of %s", wait)
+	}
+}
+
+func TestPooledUsername(t *testing.T) {
+	ctx := getContext()
+	ctx.Username = "tav"
+	freeContext(ctx)
+	if ctx = getContext(); ctx.Username != "" {
+		t.Fatalf("username leaked from a pooled context: %q", ctx.Username)
+	}
+	freeContext(ctx)
+}
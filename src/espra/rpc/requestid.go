@@ -0,0 +1,76 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// panicError holds an unexpected panic along with the stack
+// trace from where it happened, so that it can be re-panicked
+// within another goroutine without losing the trace.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+// capturePanic wraps unexpected panic values so as to capture
+// their stack trace. It needs to be called from within the
+// deferred function which recovered the value.
+func capturePanic(e interface{}) interface{} {
+	switch e.(type) {
+	case nil, *Error, *panicError, notModified, redirect:
+		return e
+	}
+	return &panicError{e, debug.Stack()}
+}
+
+// newRequestID returns the App Engine request log ID if there
+// is one, and a random ID otherwise.
+func newRequestID(r *http.Request) string {
+	if r != nil {
+		if id := r.Header.Get("X-Appengine-Request-Log-Id"); id != "" {
+			return id
+		}
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// recoverError returns the error to send to clients for the
+// recovered value. Unexpected panics are logged with their
+// stack trace and the request ID, and clients are only told
+// the ID so that internal details aren't leaked. The ID is
+// passed in as the context may not have been set up yet. Like
+// capturePanic, it needs to be called from the deferred
+// function which recovered the value.
+func (ctx *Context) recoverError(id string, e interface{}) *Error {
+	if err, ok := e.(*Error); ok {
+		return err
+	}
+	p, ok := capturePanic(e).(*panicError)
+	if !ok {
+		return toError(e)
+	}
+	var (
+		log  Logger = memoryBackend
+		meth string
+	)
+	if ctx != nil {
+		meth = ctx.meth
+		if ctx.Backend != nil {
+			log = ctx.Backend
+		}
+	}
+	log.Criticalf("rpc: panic in %s (id=%s): %v\n%s", meth, id, p.value, p.stack)
+	return NewError(InternalError, "internal error (id=%s)", id)
+}
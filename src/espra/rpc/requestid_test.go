@@ -0,0 +1,16 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"testing"
+)
+
+func TestRecoverError(t *testing.T) {
+	var ctx *Context
+	err := ctx.recoverError("abc123", "boom")
+	if err.Code != InternalError || err.Message != "internal error (id=abc123)" {
+		t.Fatalf("got unexpected error without a context: %#v", err)
+	}
+}
@@ -4,10 +4,9 @@
 package rpc
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"bytes"
 	"encoding/json"
+	"espra/msgpack"
 	"espra/session"
 	"fmt"
 	"io"
@@ -17,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -35,20 +35,35 @@ var (
 type Header map[string]interface{}
 
 type Context struct {
-	App        appengine.Context
+	Backend    Backend
 	Header     Header
+	RequestID  string
 	RespHeader Header
 	Username   string
+	abandon    func(sub *Context, o *outcome)
+	authDone   bool
+	authErr    *Error
+	binary     bool
 	buf        *bytes.Buffer
+	deadline   time.Time
+	done       chan struct{}
 	enc        *json.Encoder
+	etag       string
+	ip         string
 	meth       string
+	modified   time.Time
 	next       *Context
 	r          *http.Request
 	req        *request
+	scopes     []string
+	scopesDone bool
+	scopesErr  *Error
+	tx         bool
+	user       string
 }
 
 func (ctx *Context) Error(format string, a ...interface{}) {
-	panic(fmt.Errorf(format, a...))
+	panic(NewError(ServiceError, format, a...))
 }
 
 func (ctx *Context) ParseUint(value, errorFormat string, defaultValue uint64) uint64 {
@@ -57,29 +72,95 @@ func (ctx *Context) ParseUint(value, errorFormat string, defaultValue uint64) ui
 	}
 	v, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		panic(fmt.Errorf(errorFormat, value))
+		panic(NewError(BadRequest, errorFormat, value))
 	}
 	return v
 }
 
-func (ctx *Context) Get(key *datastore.Key, dst interface{}) error {
-	return datastore.Get(ctx.App, key, dst)
+func (ctx *Context) Delete(key *Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ctx.Backend.Delete(key)
+}
+
+func (ctx *Context) Get(key *Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ctx.Backend.Get(key, dst); err != nil {
+		return err
+	}
+	return ctx.migrate(key, reflect.ValueOf(dst))
+}
+
+func (ctx *Context) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var n int
+	slice := reflect.ValueOf(dst)
+	if !q.KeysOnly && slice.Kind() == reflect.Ptr {
+		slice = slice.Elem()
+		if slice.Kind() == reflect.Slice {
+			n = slice.Len()
+		}
+	}
+	keys, err := ctx.Backend.GetAll(q, dst)
+	if err != nil || q.KeysOnly || schemas[q.Kind] == nil {
+		return keys, err
+	}
+	for i, key := range keys {
+		entity := slice.Index(n + i)
+		if entity.Kind() != reflect.Ptr {
+			entity = entity.Addr()
+		}
+		if err := ctx.migrate(key, entity); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (ctx *Context) Put(key *Key, src interface{}) (*Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx.stampVersion(key, src)
+	return ctx.Backend.Put(key, src)
+}
+
+// RunInTransaction runs f within a transaction. The storage
+// operations on the Context passed to f form part of the
+// transaction.
+func (ctx *Context) RunInTransaction(f func(ctx *Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ctx.Backend.RunInTransaction(func(tx Backend) error {
+		return f(ctx.inTransaction(tx))
+	})
 }
 
-func (ctx *Context) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
-	return datastore.Put(ctx.App, key, src)
+// inTransaction returns a copy of the Context which uses the
+// given transaction's Backend.
+func (ctx *Context) inTransaction(tx Backend) *Context {
+	txctx := *ctx
+	txctx.Backend = tx
+	txctx.tx = true
+	return &txctx
 }
 
-func (ctx *Context) IntKey(kind string, id int64, parent *datastore.Key) *datastore.Key {
-	return datastore.NewKey(ctx.App, kind, "", id, parent)
+func (ctx *Context) IntKey(kind string, id int64, parent *Key) *Key {
+	return NewKey(kind, "", id, parent)
 }
 
-func (ctx *Context) NewKey(kind string, parent *datastore.Key) *datastore.Key {
-	return datastore.NewKey(ctx.App, kind, "", 0, parent)
+func (ctx *Context) NewKey(kind string, parent *Key) *Key {
+	return NewKey(kind, "", 0, parent)
 }
 
-func (ctx *Context) StrKey(kind, name string, parent *datastore.Key) *datastore.Key {
-	return datastore.NewKey(ctx.App, kind, name, 0, parent)
+func (ctx *Context) StrKey(kind, name string, parent *Key) *Key {
+	return NewKey(kind, name, 0, parent)
 }
 
 func (ctx *Context) Redirect(location string) {
@@ -99,9 +180,21 @@ func getContext() *Context {
 		free = ctx.next
 		mutex.Unlock()
 		ctx.buf.Reset()
-		*ctx.req = request{}
 	}
 	*ctx.req = request{}
+	ctx.Username = ""
+	ctx.abandon = nil
+	ctx.authDone = false
+	ctx.authErr = nil
+	ctx.binary = false
+	ctx.etag = ""
+	ctx.ip = ""
+	ctx.modified = time.Time{}
+	ctx.r = nil
+	ctx.scopes = nil
+	ctx.scopesDone = false
+	ctx.scopesErr = nil
+	ctx.user = ""
 	return ctx
 }
 
@@ -113,13 +206,23 @@ func freeContext(ctx *Context) {
 }
 
 type service struct {
-	anon   bool
-	args   []reflect.Type
-	cache  int
-	in     int
-	meth   reflect.Value
-	isGet  bool
-	retErr bool
+	anon         bool
+	args         []reflect.Type
+	cache        int
+	deprecated   bool
+	idempotent   time.Duration
+	in           int
+	interceptors []Interceptor
+	limit        *Limit
+	meth         reflect.Value
+	notice       string
+	isGet        bool
+	params       []*param
+	retErr       bool
+	scopes       []string
+	timeout      time.Duration
+	validators   []*structValidator
+	version      int
 }
 
 func (s *service) Anon() *service {
@@ -135,8 +238,9 @@ func (s *service) Cache(duration int) *service {
 type redirect string
 
 type request struct {
-	Header Header             `json:"header"`
-	Call   []*json.RawMessage `json:"call"`
+	Header Header               `json:"header"`
+	Call   []*json.RawMessage   `json:"call"`
+	Batch  [][]*json.RawMessage `json:"batch"`
 }
 
 type response struct {
@@ -144,96 +248,93 @@ type response struct {
 	Reply  []interface{} `json:"reply"`
 }
 
-var (
-	errOpen = []byte(`{"error":`)
-	errEnc  = []byte(`"runtime error: couldn't encode JSON response"`)
-	errEnd  = []byte(`}`)
-)
+type batchResponse struct {
+	Header Header    `json:"header"`
+	Batch  []*result `json:"batch"`
+}
 
-func Error(format string, a ...interface{}) {
-	panic(fmt.Errorf(format, a...))
+// result holds either the reply or the error for a single
+// call within a batch.
+type result struct {
+	Reply []interface{} `json:"reply,omitempty"`
+	Error *Error        `json:"error,omitempty"`
 }
 
-func Handle(w http.ResponseWriter, r *http.Request) {
+// authenticate sets the Username on the context from the
+// request's 'auth' header field. The session lookup is only
+// done once per request so that batched calls can share it.
+func (ctx *Context) authenticate() {
+	if !ctx.authDone {
+		ctx.authDone = true
+		ctx.user, ctx.authErr = resolveAuth(ctx.Header)
+	}
+	if ctx.authErr != nil {
+		panic(ctx.authErr)
+	}
+	ctx.Username = ctx.user
+}
 
-	var (
-		ctx  *Context
-		resp []byte
-	)
+func resolveAuth(hdr Header) (string, *Error) {
+	v, ok := hdr["auth"]
+	if !ok {
+		return "", NewError(AuthRequired, "missing 'auth' header field")
+	}
+	auth, ok := v.(string)
+	if !ok {
+		return "", NewError(BadRequest, "'auth' header field needs to be a string")
+	}
+	username, ok := session.Info(auth)
+	if !ok {
+		return "", NewError(AuthExpired, "auth expired")
+	}
+	return username, nil
+}
 
-	defer func() {
-		if ctx != nil {
-			freeContext(ctx)
-		}
-		if e := recover(); e != nil {
-			if redir, yes := e.(redirect); yes {
-				http.Redirect(w, r, string(redir), http.StatusFound)
-				return
-			}
-			msg, err := json.Marshal(fmt.Sprint(e))
-			if err != nil {
-				msg = errEnc
-			}
-			w.Write(errOpen)
-			w.Write(msg)
-			w.Write(errEnd)
-		} else {
-			w.Write(resp)
-		}
-	}()
+// call decodes and dispatches a single call of the form
+// [name, args...] and returns the service's replies.
+func (ctx *Context) call(call []*json.RawMessage) []interface{} {
 
-	if r.Method != "POST" {
-		Error("bad request: required POST, received %s", r.Method)
+	if len(call) == 0 {
+		Raise(BadRequest, "missing 'call' parameter")
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
-		panic(err)
+	ctx.meth = ""
+	if call[0] == nil || ctx.unmarshal(*call[0], &ctx.meth) != nil {
+		Raise(BadRequest, "first element of 'call' needs to be a string")
 	}
 
-	ctx = getContext()
-	if json.Unmarshal(body, ctx.req) != nil {
-		panic("bad request: error parsing JSON request")
-	}
+	return ctx.run(ctx.lookup(ctx.meth), call[1:])
 
-	call := ctx.req.Call
-	if call == nil {
-		panic("bad request: missing 'call' parameter")
-	}
+}
 
-	if json.Unmarshal(*call[0], &ctx.meth) != nil {
-		panic("bad request: first element of 'call' needs to be a string")
-	}
+// run authenticates the caller if needed, decodes the
+// arguments and then invokes the service.
+func (ctx *Context) run(s *service, call []*json.RawMessage) []interface{} {
 
-	s, exists := services[ctx.meth]
-	if !exists {
-		Error("service not found: %s", ctx.meth)
-	}
+	start := time.Now()
+	defer func() {
+		e := recover()
+		recordCall(ctx.meth, start, e)
+		if e != nil {
+			panic(e)
+		}
+	}()
 
-	call = call[1:]
 	if s.in != len(call) {
-		Error("bad request: %s takes %d arguments, got %d", ctx.meth, s.in, len(call))
+		Raise(BadRequest, "%s takes %d arguments, got %d", ctx.meth, s.in, len(call))
 	}
 
-	if s.anon {
+	if s.anon && s.scopes == nil {
 		ctx.Username = ""
 	} else {
-		hdr, ok := ctx.req.Header["auth"]
-		if !ok {
-			panic("bad request: missing 'auth' header field")
-		}
-		auth, ok := hdr.(string)
-		if !ok {
-			panic("bad request: 'auth' header field needs to be a string")
-		}
-		ctx.Username, ok = session.Info(auth)
-		if !ok {
-			panic("auth expired")
+		ctx.authenticate()
+		if s.scopes != nil {
+			ctx.authorize(s)
 		}
 	}
+	ctx.checkLimits(s)
 
-	args := make([]reflect.Value, s.in+1)
+	args := make([]interface{}, s.in)
 	for i, req := range call {
 		var rv reflect.Value
 		typ := s.args[i]
@@ -243,38 +344,138 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 		} else {
 			rv = reflect.New(typ)
 		}
-		if err = json.Unmarshal(*req, rv.Interface()); err != nil {
-			panic("bad request: " + err.Error())
+		if req == nil {
+			Raise(BadRequest, "null value for argument %d of %s", i+1, ctx.meth)
+		}
+		if err := ctx.unmarshal(*req, rv.Interface()); err != nil {
+			Raise(BadRequest, "invalid argument %d for %s: %s", i+1, ctx.meth, err)
 		}
 		if !ptr {
 			rv = rv.Elem()
 		}
-		args[i+1] = rv
+		args[i] = rv.Interface()
 	}
 
-	ctx.App = appengine.NewContext(r)
-	ctx.Header = ctx.req.Header
-	ctx.RespHeader = make(Header)
+	s.validate(ctx.meth, args)
+	if s.idempotent > 0 {
+		return ctx.invokeIdempotent(s, args)
+	}
+	return ctx.invoke(s, args)
 
-	args[0] = reflect.ValueOf(ctx)
-	rargs := s.meth.Call(args)
+}
 
-	rlen := len(rargs)
-	if s.retErr {
-		if reterr := rargs[rlen-1].Interface().(error); reterr != nil {
-			panic(reterr)
+// dispatch is like call, except that any errors are caught
+// and returned as part of the result.
+func (ctx *Context) dispatch(call []*json.RawMessage) (res *result) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, yes := e.(redirect); yes {
+				e = NewError(BadRequest, "%s cannot redirect within a batch", ctx.meth)
+			}
+			res = &result{Error: ctx.recoverError(ctx.RequestID, e)}
+		}
+	}()
+	return &result{Reply: ctx.call(call)}
+}
+
+// invoke calls the service through its interceptor chain and
+// panics if the service returns a non-nil error.
+func (ctx *Context) invoke(s *service, args []interface{}) []interface{} {
+	if s.timeout > 0 {
+		return ctx.invokeTimeout(s, args)
+	}
+	reply, err := s.handler(ctx.meth)(ctx, args)
+	if err != nil {
+		panic(toError(err))
+	}
+	return reply
+}
+
+func Handle(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		ctx  *Context
+		resp []byte
+	)
+
+	id := newRequestID(r)
+	w.Header().Set("X-Request-Id", id)
+	binary := isMsgpack(r.Header.Get("Content-Type"))
+
+	defer func() {
+		var hdr Header
+		e := recover()
+		if e != nil {
+			if redir, yes := e.(redirect); yes {
+				http.Redirect(w, r, string(redir), http.StatusFound)
+			} else {
+				if ctx != nil {
+					hdr = ctx.RespHeader
+				}
+				if binary {
+					writeMsgpackError(w, hdr, ctx.recoverError(id, e))
+				} else {
+					writeError(w, hdr, ctx.recoverError(id, e))
+				}
+			}
+		} else {
+			w.Write(resp)
 		}
-		rargs = rargs[:rlen-1]
-		rlen -= 1
+		if ctx != nil {
+			freeContext(ctx)
+		}
+	}()
+
+	if r.Method != "POST" {
+		Raise(MethodNotAllowed, "required POST, received %s", r.Method)
 	}
 
-	res := &response{ctx.RespHeader, make([]interface{}, rlen)}
-	for i, arg := range rargs {
-		res.Reply[i] = arg.Interface()
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		Raise(BadRequest, "couldn't read request body: %s", err)
+	}
+
+	ctx = getContext()
+	if binary {
+		ctx.binary = true
+		if err = decodeMsgpack(body, ctx.req); err != nil {
+			Raise(BadRequest, "error parsing MessagePack request: %s", err)
+		}
+	} else if json.Unmarshal(body, ctx.req) != nil {
+		Raise(BadRequest, "error parsing JSON request")
+	}
+
+	ctx.Backend = newBackend(r)
+	ctx.Header = ctx.req.Header
+	ctx.RequestID = id
+	ctx.RespHeader = Header{"request_id": id}
+	ctx.ip = remoteIP(r)
+
+	var res interface{}
+	if batch := ctx.req.Batch; batch != nil {
+		if ctx.req.Call != nil {
+			Raise(BadRequest, "only one of 'call' or 'batch' can be specified")
+		}
+		results := make([]*result, len(batch))
+		for i, call := range batch {
+			results[i] = ctx.dispatch(call)
+		}
+		res = &batchResponse{ctx.RespHeader, results}
+	} else {
+		res = &response{ctx.RespHeader, ctx.call(ctx.req.Call)}
+	}
+
+	if binary {
+		if resp, err = msgpack.Marshal(res); err != nil {
+			Raise(InternalError, "couldn't encode MessagePack response: %s", err)
+		}
+		w.Header().Set("Content-Type", MsgpackType)
+		return
 	}
 
 	if err = ctx.enc.Encode(res); err != nil {
-		panic(err)
+		Raise(InternalError, "couldn't encode JSON response: %s", err)
 	}
 
 	resp = ctx.buf.Bytes()
@@ -288,89 +489,77 @@ func HandleGet(path string, w http.ResponseWriter, r *http.Request) {
 	call := strings.Split(path, "/")
 	name := call[0]
 
-	m := appengine.NewContext(r)
-	m.Infof("path: %s", path)
-
 	s, exists := getServices[name]
 	if !exists {
-		http.NotFound(w, r)
+		writeError(w, nil, NewError(ServiceNotFound, "service not found: %s", name))
 		return
 	}
 
 	var (
-		ctx  *Context
-		resp []byte
-		sent bool
+		ctx   *Context
+		id    = newRequestID(r)
+		resp  []byte
+		start = time.Now()
 	)
 
-	defer func() {
-		if ctx != nil {
-			freeContext(ctx)
+	w.Header().Set("X-Request-Id", id)
+
+	setCacheHeaders := func() {
+		if s.cache > 60 {
+			w.Header().Set("Pragma", "public")
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.cache))
 		}
-		if !sent {
-			if e := recover(); e != nil {
-				if redir, yes := e.(redirect); yes {
-					if s.cache > 60 {
-						w.Header().Set("Pragma", "public")
-						w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.cache))
-					}
-					http.Redirect(w, r, string(redir), 302)
-					return
-				}
-				http.Error(w, fmt.Sprint(e), 500)
+	}
+
+	defer func() {
+		e := recover()
+		recordCall(name, start, e)
+		if e != nil {
+			if redir, yes := e.(redirect); yes {
+				setCacheHeaders()
+				http.Redirect(w, r, string(redir), 302)
+			} else if _, yes := e.(notModified); yes {
+				setCacheHeaders()
+				ctx.setValidators(w)
+				w.WriteHeader(http.StatusNotModified)
 			} else {
-				if s.cache > 60 {
-					w.Header().Set("Pragma", "public")
-					w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.cache))
-				}
-				w.Write(resp)
+				writeError(w, nil, ctx.recoverError(id, e))
 			}
+		} else {
+			setCacheHeaders()
+			ctx.setValidators(w)
+			w.Write(resp)
+		}
+		if ctx != nil {
+			freeContext(ctx)
 		}
 	}()
 
 	if r.Method != "GET" {
-		http.Error(w, fmt.Sprintf("bad request: required GET, received %s", r.Method), 405)
-		sent = true
-		return
+		Raise(MethodNotAllowed, "required GET, received %s", r.Method)
 	}
 
-	diff := s.in + 1 - len(call)
-
-	if diff < 0 {
-		http.Error(w, fmt.Sprintf("bad request: too many arguments for %s", name), 400)
-		sent = true
-		return
-	}
-
-	for diff > 0 {
-		call = append(call, "")
-		diff -= 1
+	if len(call)-1 > s.in {
+		Raise(BadRequest, "too many arguments for %s", name)
 	}
 
 	ctx = getContext()
-	args := make([]reflect.Value, s.in+1)
-	for i, param := range call {
-		if i == 0 {
-			continue
-		}
-		args[i] = reflect.ValueOf(param)
-	}
+	args := s.getArgs(call[1:], r.URL.Query())
 
-	ctx.App = appengine.NewContext(r)
+	ctx.Backend = newBackend(r)
 	ctx.Header = nil
+	ctx.RequestID = id
 	ctx.RespHeader = nil
-
-	args[0] = reflect.ValueOf(ctx)
-	rargs := s.meth.Call(args)
-
+	ctx.ip = remoteIP(r)
+	ctx.meth = name
+	ctx.r = r
+
+	// GET services are always anonymous, so callers are rate
+	// limited by their IP address.
+	ctx.Username = ""
+	ctx.checkLimits(s)
+	rargs := ctx.invoke(s, args)
 	rlen := len(rargs)
-	if s.retErr {
-		if reterr := rargs[rlen-1].Interface().(error); reterr != nil {
-			panic(reterr)
-		}
-		rargs = rargs[:rlen-1]
-		rlen -= 1
-	}
 
 	if rlen == 0 {
 		resp = doneOK
@@ -380,11 +569,11 @@ func HandleGet(path string, w http.ResponseWriter, r *http.Request) {
 			v  interface{}
 		)
 		if rlen == 2 {
-			ct = rargs[0].String()
-			v = rargs[1].Interface()
+			ct = reflect.ValueOf(rargs[0]).String()
+			v = rargs[1]
 		} else {
 			ct = "text/plain; charset=utf-8"
-			v = rargs[0].Interface()
+			v = rargs[0]
 		}
 		if reader, ok := v.(io.ReadCloser); ok {
 			resp, _ = ioutil.ReadAll(reader)
@@ -396,19 +585,25 @@ func HandleGet(path string, w http.ResponseWriter, r *http.Request) {
 		} else if content, ok := v.(string); ok {
 			resp = []byte(content)
 		} else {
-			panic("unsupported response type: " + reflect.TypeOf(v).Kind().String())
+			Raise(InternalError, "unsupported response type: %T", v)
 		}
 		w.Header().Set("Content-Type", ct)
 	}
 
+	if ctx.etag == "" && s.cache > 0 {
+		ctx.etag = computeETag(resp)
+	}
+
+	ctx.checkModified()
+
 }
 
 var (
-	services    = map[string]*service{}
+	services    = map[string][]*service{}
 	getServices = map[string]*service{}
 )
 
-func register(name string, v interface{}, isGet bool) *service {
+func register(name string, version int, v interface{}, isGet bool) *service {
 	rv := reflect.ValueOf(v)
 	rt := rv.Type()
 	if rt.Kind() != reflect.Func {
@@ -419,14 +614,22 @@ func register(name string, v interface{}, isGet bool) *service {
 		panic("rpc: the first argument for `" + name + "` needs to be *rpc.Context")
 	}
 	args := make([]reflect.Type, in)
+	seen := map[reflect.Type]*structValidator{}
+	validators := make([]*structValidator, in)
 	for i := 0; i < in; i++ {
 		args[i] = rt.In(i + 1)
+		if isGet && !isParamType(args[i]) {
+			panic("rpc: unsupported parameter type `" + args[i].String() + "` for the GET service `" + name + "`")
+		}
+		validators[i] = compileValidator(args[i], seen)
 	}
 	s := &service{
-		args:  args,
-		in:    in,
-		isGet: isGet,
-		meth:  rv,
+		args:       args,
+		in:         in,
+		isGet:      isGet,
+		meth:       rv,
+		validators: validators,
+		version:    version,
 	}
 	if respCount := rt.NumOut(); respCount >= 1 {
 		p := rt.Out(respCount - 1)
@@ -437,25 +640,25 @@ func register(name string, v interface{}, isGet bool) *service {
 	if isGet {
 		getServices[name] = s
 	} else {
-		services[name] = s
+		addVersion(name, s)
 	}
 	return s
 }
 
 func Register(name string, v interface{}) *service {
-	return register(name, v, false)
+	return register(name, 1, v, false)
 }
 
 func RegisterGet(name string, v interface{}) *service {
-	return register(name, v, true)
+	return register(name, 1, v, true)
 }
 
 type Namespace string
 
 func (ns Namespace) Register(name string, v interface{}) *service {
-	return register(string(ns)+"."+name, v, false)
+	return register(string(ns)+"."+name, 1, v, false)
 }
 
 func (ns Namespace) RegisterGet(name string, v interface{}) *service {
-	return register(string(ns)+"."+name, v, true)
+	return register(string(ns)+"."+name, 1, v, true)
 }
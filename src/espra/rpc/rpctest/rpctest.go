@@ -0,0 +1,128 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+// Package rpctest provides helpers for calling registered rpc
+// services in-process, without an App Engine dev server.
+//
+//	c := rpctest.New("tav")
+//	res := c.Call("item.create", &item.CreateRequest{...})
+//	if res.Err != nil {
+//		t.Fatal(res.Err)
+//	}
+package rpctest
+
+import (
+	"encoding/json"
+	"espra/rpc"
+	"net/url"
+	"strings"
+)
+
+// Context holds the caller details and storage used for
+// calls. The Backend is shared across calls, so entities Put
+// by one call can be loaded by subsequent ones.
+type Context struct {
+	Backend  *rpc.MemoryBackend
+	Header   rpc.Header
+	Scopes   []string
+	Username string
+}
+
+// New returns a Context for calling services as the given
+// user with an empty in-memory backend. An empty username
+// results in unauthenticated calls.
+func New(username string) *Context {
+	return &Context{
+		Backend:  rpc.NewMemoryBackend(),
+		Header:   rpc.Header{},
+		Username: username,
+	}
+}
+
+// Result holds the outcome of a call. Location is set if the
+// service redirected.
+type Result struct {
+	Err        *rpc.Error
+	Location   string
+	Reply      []interface{}
+	RespHeader rpc.Header
+}
+
+// Decode sets the values pointed to by dst from the JSON
+// encoding of the replies, i.e. as seen by clients.
+func (r *Result) Decode(dst ...interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i, v := range dst {
+		if i >= len(r.Reply) {
+			break
+		}
+		data, err := json.Marshal(r.Reply[i])
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Context) context() *rpc.Context {
+	ctx := rpc.NewContext(c.Backend, c.Username, c.Scopes)
+	for k, v := range c.Header {
+		ctx.Header[k] = v
+	}
+	return ctx
+}
+
+// Call calls the named service with the JSON encoding of the
+// given arguments. Values of type json.RawMessage are passed
+// through as is.
+func (c *Context) Call(name string, args ...interface{}) *Result {
+	raw := make([]*json.RawMessage, len(args))
+	for i, arg := range args {
+		msg, ok := arg.(json.RawMessage)
+		if !ok {
+			data, err := json.Marshal(arg)
+			if err != nil {
+				return &Result{Err: rpc.NewError(rpc.BadRequest, "couldn't encode argument %d: %s", i+1, err)}
+			}
+			msg = json.RawMessage(data)
+		}
+		raw[i] = &msg
+	}
+	ctx := c.context()
+	reply, location, err := ctx.Call(name, raw)
+	return &Result{err, location, reply, ctx.RespHeader}
+}
+
+// CallJSON calls the named service with arguments given as a
+// JSON array, e.g. `["tav", 150]`.
+func (c *Context) CallJSON(name string, args string) *Result {
+	var raw []*json.RawMessage
+	if err := json.Unmarshal([]byte(args), &raw); err != nil {
+		return &Result{Err: rpc.NewError(rpc.BadRequest, "error parsing JSON arguments: %s", err)}
+	}
+	ctx := c.context()
+	reply, location, err := ctx.Call(name, raw)
+	return &Result{err, location, reply, ctx.RespHeader}
+}
+
+// Get calls a GET service using a path in the same form as
+// HandleGet, optionally with a query string, e.g.
+// profile.gravatar/tav?size=80.
+func (c *Context) Get(path string) *Result {
+	var query url.Values
+	if idx := strings.Index(path, "?"); idx != -1 {
+		q, err := url.ParseQuery(path[idx+1:])
+		if err != nil {
+			return &Result{Err: rpc.NewError(rpc.BadRequest, "invalid query string: %s", err)}
+		}
+		path, query = path[:idx], q
+	}
+	ctx := c.context()
+	reply, location, err := ctx.CallGet(path, query)
+	return &Result{err, location, reply, ctx.RespHeader}
+}
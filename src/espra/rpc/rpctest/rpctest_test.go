@@ -0,0 +1,100 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpctest
+
+import (
+	"espra/rpc"
+	"strconv"
+	"testing"
+)
+
+type greeting struct {
+	Name string `json:"name" validate:"required"`
+}
+
+func greet(ctx *rpc.Context, req *greeting) (string, error) {
+	ctx.RespHeader["greeted"] = req.Name
+	return "hello " + req.Name + " from " + ctx.Username, nil
+}
+
+func square(ctx *rpc.Context, n int) string {
+	return strconv.Itoa(n * n)
+}
+
+func greetV2(ctx *rpc.Context, req *greeting) (string, error) {
+	return "hi " + req.Name, nil
+}
+
+func init() {
+	rpc.Register("rpctest.greet", greet).Deprecated("use version 2")
+	rpc.RegisterVersion("rpctest.greet", 2, greetV2)
+	rpc.RegisterGet("rpctest.square", square).Params("n=2")
+}
+
+func TestCall(t *testing.T) {
+	c := New("tav")
+	res := c.Call("rpctest.greet", &greeting{"alice"})
+	var reply string
+	if err := res.Decode(&reply); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reply != "hello alice from tav" {
+		t.Errorf("got unexpected reply: %q", reply)
+	}
+	if res.RespHeader["greeted"] != "alice" {
+		t.Errorf("response header wasn't set: %v", res.RespHeader)
+	}
+	res = c.CallJSON("rpctest.greet", `[{"name": ""}]`)
+	if res.Err == nil || res.Err.Code != rpc.BadRequest {
+		t.Errorf("expected bad request error, got: %v", res.Err)
+	}
+	res = New("").Call("rpctest.greet", &greeting{"alice"})
+	if res.Err == nil || res.Err.Code != rpc.AuthRequired {
+		t.Errorf("expected auth required error, got: %v", res.Err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := New("")
+	for path, expected := range map[string]string{
+		"rpctest.square":       "4",
+		"rpctest.square/3":     "9",
+		"rpctest.square?n=5":   "25",
+		"rpctest.square/6?n=5": "36",
+	} {
+		res := c.Get(path)
+		if res.Err != nil {
+			t.Fatalf("unexpected error for %s: %s", path, res.Err)
+		}
+		if res.Reply[0] != expected {
+			t.Errorf("got %q for %s, expected %q", res.Reply[0], path, expected)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	c := New("tav")
+	for version, expected := range map[int]string{
+		0: "hello alice from tav",
+		1: "hello alice from tav",
+		2: "hi alice",
+		5: "hi alice",
+	} {
+		delete(c.Header, "version")
+		if version > 0 {
+			c.Header["version"] = version
+		}
+		res := c.Call("rpctest.greet", &greeting{"alice"})
+		if res.Err != nil {
+			t.Fatalf("unexpected error for version %d: %s", version, res.Err)
+		}
+		if res.Reply[0] != expected {
+			t.Errorf("got %q for version %d, expected %q", res.Reply[0], version, expected)
+		}
+		_, warned := res.RespHeader["warnings"]
+		if warned != (version < 2) {
+			t.Errorf("unexpected deprecation warnings for version %d: %v", version, res.RespHeader["warnings"])
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"strings"
+)
+
+// ScopeResolver returns the scopes granted to the caller of
+// the current request, e.g. by looking up the client token
+// identified by the 'auth' header field.
+type ScopeResolver func(ctx *Context) ([]string, error)
+
+var scopeResolver ScopeResolver
+
+// SetScopeResolver sets the function used to find the scopes
+// granted to callers. Until it is set, calls to services which
+// require scopes are always rejected.
+func SetScopeResolver(f ScopeResolver) {
+	scopeResolver = f
+}
+
+// Scopes sets the scopes, e.g. "items:write", that a caller
+// needs to have been granted in order to call the service.
+// Services with scopes always require authentication, and so
+// GET services cannot have them.
+func (s *service) Scopes(scopes ...string) *service {
+	if s.isGet {
+		panic("rpc: GET services cannot require scopes")
+	}
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " ,*") {
+			panic("rpc: invalid scope for service: " + scope)
+		}
+	}
+	s.scopes = append(s.scopes, scopes...)
+	return s
+}
+
+// HasScope returns whether the scope is covered by the
+// granted scopes. A granted scope of * covers everything and
+// one ending in :* covers all scopes with that prefix, e.g.
+// items:* covers items:read and items:write.
+func HasScope(granted []string, scope string) bool {
+	for _, g := range granted {
+		if g == scope || g == "*" {
+			return true
+		}
+		if strings.HasSuffix(g, ":*") && strings.HasPrefix(scope, g[:len(g)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedScopes returns the scopes granted to the caller. They
+// are only resolved once per request.
+func (ctx *Context) grantedScopes() ([]string, *Error) {
+	if !ctx.scopesDone {
+		ctx.scopesDone = true
+		if scopeResolver == nil {
+			ctx.scopesErr = NewError(Forbidden, "scopes cannot be resolved")
+		} else {
+			scopes, err := scopeResolver(ctx)
+			if err != nil {
+				ctx.scopesErr = toError(err)
+			}
+			ctx.scopes = scopes
+		}
+	}
+	return ctx.scopes, ctx.scopesErr
+}
+
+// authorize checks that the authenticated caller has been
+// granted all of the scopes required by the service.
+func (ctx *Context) authorize(s *service) {
+	granted, err := ctx.grantedScopes()
+	if err != nil {
+		panic(err)
+	}
+	var missing []string
+	for _, scope := range s.scopes {
+		if !HasScope(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if missing != nil {
+		panic(&Error{
+			Code:    Forbidden,
+			Message: "insufficient scope for " + ctx.meth,
+			Data:    map[string][]string{"scopes": missing},
+		})
+	}
+}
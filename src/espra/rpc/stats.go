@@ -0,0 +1,173 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets defines the upper bounds, in seconds, of the
+// buckets used for the latency histograms.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram holds the number of observations which fall within
+// each of the LatencyBuckets, with the final count being for
+// those which exceed all of them.
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+}
+
+func (h *Histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[i] += 1
+	h.Count += 1
+	h.Sum += v
+}
+
+// ServiceStats holds the metrics for calls to a service since
+// the instance started.
+type ServiceStats struct {
+	Name    string            `json:"name"`
+	Calls   uint64            `json:"calls"`
+	Errors  map[string]uint64 `json:"errors"`
+	Latency *Histogram        `json:"latency"`
+}
+
+var (
+	stats      = map[string]*ServiceStats{}
+	statsMutex sync.Mutex
+)
+
+// recordCall updates the metrics for the named service with
+// the outcome of a call. Redirects and not modified responses
+// aren't counted as errors.
+func recordCall(name string, start time.Time, e interface{}) {
+	elapsed := time.Since(start).Seconds()
+	code := ""
+	switch err := e.(type) {
+	case nil, notModified, redirect:
+	case *Error:
+		code = err.Code
+	default:
+		code = InternalError
+	}
+	statsMutex.Lock()
+	s, exists := stats[name]
+	if !exists {
+		s = &ServiceStats{
+			Name:   name,
+			Errors: map[string]uint64{},
+			Latency: &Histogram{
+				Buckets: LatencyBuckets,
+				Counts:  make([]uint64, len(LatencyBuckets)+1),
+			},
+		}
+		stats[name] = s
+	}
+	s.Calls += 1
+	if code != "" {
+		s.Errors[code] += 1
+	}
+	s.Latency.observe(elapsed)
+	statsMutex.Unlock()
+}
+
+type statsList []*ServiceStats
+
+func (l statsList) Len() int {
+	return len(l)
+}
+
+func (l statsList) Less(i, j int) bool {
+	return l[i].Name < l[j].Name
+}
+
+func (l statsList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Stats returns a snapshot of the metrics for all services
+// which have been called on this instance, sorted by name.
+func Stats() []*ServiceStats {
+	statsMutex.Lock()
+	list := make([]*ServiceStats, 0, len(stats))
+	for _, s := range stats {
+		errors := map[string]uint64{}
+		for code, n := range s.Errors {
+			errors[code] = n
+		}
+		latency := *s.Latency
+		latency.Counts = append([]uint64(nil), s.Latency.Counts...)
+		list = append(list, &ServiceStats{s.Name, s.Calls, errors, &latency})
+	}
+	statsMutex.Unlock()
+	sort.Sort(statsList(list))
+	return list
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteStats writes the metrics in the Prometheus text format.
+func WriteStats(w io.Writer, list []*ServiceStats) {
+	fmt.Fprint(w, "# HELP rpc_calls_total The number of calls to the service.\n# TYPE rpc_calls_total counter\n")
+	for _, s := range list {
+		fmt.Fprintf(w, "rpc_calls_total{service=%q} %d\n", s.Name, s.Calls)
+	}
+	fmt.Fprint(w, "# HELP rpc_errors_total The number of failed calls to the service by error code.\n# TYPE rpc_errors_total counter\n")
+	for _, s := range list {
+		codes := make([]string, 0, len(s.Errors))
+		for code := range s.Errors {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "rpc_errors_total{service=%q,code=%q} %d\n", s.Name, code, s.Errors[code])
+		}
+	}
+	fmt.Fprint(w, "# HELP rpc_latency_seconds The latency of calls to the service.\n# TYPE rpc_latency_seconds histogram\n")
+	for _, s := range list {
+		h := s.Latency
+		cumulative := uint64(0)
+		for i, bound := range h.Buckets {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(w, "rpc_latency_seconds_bucket{service=%q,le=%q} %d\n", s.Name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "rpc_latency_seconds_bucket{service=%q,le=\"+Inf\"} %d\n", s.Name, h.Count)
+		fmt.Fprintf(w, "rpc_latency_seconds_sum{service=%q} %s\n", s.Name, formatFloat(h.Sum))
+		fmt.Fprintf(w, "rpc_latency_seconds_count{service=%q} %d\n", s.Name, h.Count)
+	}
+}
+
+// HandleStats serves the metrics as JSON, or in the Prometheus
+// text format if the format query parameter is set to
+// prometheus or the client only accepts text/plain. Callers
+// need to restrict access to it.
+func HandleStats(w http.ResponseWriter, r *http.Request) {
+	list := Stats()
+	if r.URL.Query().Get("format") == "prometheus" || strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteStats(w, list)
+		return
+	}
+	resp, err := json.Marshal(list)
+	if err != nil {
+		writeError(w, nil, NewError(InternalError, "couldn't encode JSON response: %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,296 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"espra/ident"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes why a specific field of an argument
+// failed validation. A list of these is sent as the data of
+// the bad request error.
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type rule struct {
+	kind  string
+	limit float64
+	re    *regexp.Regexp
+}
+
+type fieldValidator struct {
+	index  int
+	name   string
+	nested *structValidator
+	rules  []*rule
+}
+
+// structValidator holds the compiled form of the `validate`
+// struct tags for a type, e.g.
+//
+//	Login string `json:"login" validate:"required,min=3,max=64"`
+//
+// Supported rules are required, min=N, max=N, username,
+// userref, ref and pattern=REGEXP. As patterns can contain
+// commas, they need to be the last rule in a tag. Rules other
+// than required are only checked for non-empty values.
+type structValidator struct {
+	fields []*fieldValidator
+}
+
+func compileValidator(t reflect.Type, seen map[reflect.Type]*structValidator) *structValidator {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if sv, ok := seen[t]; ok {
+		return sv
+	}
+	sv := &structValidator{}
+	seen[t] = sv
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fv := &fieldValidator{
+			index:  i,
+			name:   name,
+			nested: compileValidator(field.Type, seen),
+		}
+		if tag := field.Tag.Get("validate"); tag != "" {
+			rules, err := parseRules(tag, field.Type)
+			if err != nil {
+				panic(fmt.Sprintf("rpc: invalid validate tag on `%s.%s`: %s", t.Name(), field.Name, err))
+			}
+			fv.rules = rules
+		}
+		if fv.rules != nil || fv.nested != nil {
+			sv.fields = append(sv.fields, fv)
+		}
+	}
+	if len(sv.fields) == 0 {
+		seen[t] = nil
+		return nil
+	}
+	return sv
+}
+
+func parseRules(tag string, t reflect.Type) ([]*rule, error) {
+	rules := []*rule{}
+	for tag != "" {
+		var spec string
+		if strings.HasPrefix(tag, "pattern=") {
+			spec, tag = tag, ""
+		} else if idx := strings.Index(tag, ","); idx != -1 {
+			spec, tag = tag[:idx], tag[idx+1:]
+		} else {
+			spec, tag = tag, ""
+		}
+		r := &rule{kind: spec}
+		if idx := strings.Index(spec, "="); idx != -1 {
+			r.kind = spec[:idx]
+			arg := spec[idx+1:]
+			switch r.kind {
+			case "min", "max":
+				limit, err := strconv.ParseFloat(arg, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s value: %q", r.kind, arg)
+				}
+				r.limit = limit
+			case "pattern":
+				re, err := regexp.Compile(arg)
+				if err != nil {
+					return nil, err
+				}
+				r.re = re
+			default:
+				return nil, fmt.Errorf("unknown rule: %q", spec)
+			}
+		} else {
+			switch r.kind {
+			case "required":
+			case "username", "userref", "ref":
+				if !isStrings(t) {
+					return nil, fmt.Errorf("the %s rule only applies to strings", r.kind)
+				}
+			default:
+				return nil, fmt.Errorf("unknown rule: %q", spec)
+			}
+		}
+		if r.kind == "pattern" && !isStrings(t) {
+			return nil, fmt.Errorf("the pattern rule only applies to strings")
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// isStrings returns whether the type is a string or a
+// slice of strings.
+func isStrings(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// size returns the value used for the min/max rules, i.e.
+// the number of characters in strings, the length of
+// collections and the value of numbers.
+func size(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Array, reflect.Map, reflect.Slice:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func checkString(r *rule, s string) string {
+	var ok bool
+	switch r.kind {
+	case "pattern":
+		if !r.re.MatchString(s) {
+			return "needs to match the pattern " + r.re.String()
+		}
+		return ""
+	case "ref":
+		_, ok = ident.Ref(s)
+	case "username":
+		_, ok = ident.Username(s)
+	case "userref":
+		_, ok = ident.UserRef(s)
+	}
+	if !ok {
+		return "invalid " + r.kind + ": " + s
+	}
+	return ""
+}
+
+func (r *rule) check(v reflect.Value) string {
+	if r.kind == "required" {
+		if isEmpty(v) {
+			return "required"
+		}
+		return ""
+	}
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	switch r.kind {
+	case "min", "max":
+		n, ok := size(v)
+		if !ok {
+			return ""
+		}
+		if r.kind == "min" && n < r.limit {
+			if v.Kind() == reflect.String {
+				return fmt.Sprintf("needs to be at least %v characters long", r.limit)
+			}
+			return fmt.Sprintf("needs to be at least %v", r.limit)
+		}
+		if r.kind == "max" && n > r.limit {
+			if v.Kind() == reflect.String {
+				return fmt.Sprintf("cannot be longer than %v characters", r.limit)
+			}
+			return fmt.Sprintf("cannot be greater than %v", r.limit)
+		}
+	default:
+		if v.Kind() == reflect.Slice {
+			for i := 0; i < v.Len(); i++ {
+				if msg := checkString(r, v.Index(i).String()); msg != "" {
+					return msg
+				}
+			}
+			return ""
+		}
+		return checkString(r, v.String())
+	}
+	return ""
+}
+
+func (sv *structValidator) validate(v reflect.Value, prefix string, errs []*FieldError) []*FieldError {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return errs
+		}
+		v = v.Elem()
+	}
+	for _, fv := range sv.fields {
+		field := v.Field(fv.index)
+		name := prefix + fv.name
+		failed := false
+		for _, r := range fv.rules {
+			if r.kind != "required" && isEmpty(field) {
+				continue
+			}
+			if msg := r.check(field); msg != "" {
+				errs = append(errs, &FieldError{name, msg})
+				failed = true
+				break
+			}
+		}
+		if !failed && fv.nested != nil {
+			errs = fv.nested.validate(field, name+".", errs)
+		}
+	}
+	return errs
+}
+
+// validate checks the decoded arguments against the
+// service's validators and raises a bad request error listing
+// all of the invalid fields.
+func (s *service) validate(name string, args []interface{}) {
+	var errs []*FieldError
+	for i, sv := range s.validators {
+		if sv != nil && args[i] != nil {
+			errs = sv.validate(reflect.ValueOf(args[i]), "", errs)
+		}
+	}
+	if errs != nil {
+		panic(&Error{Code: BadRequest, Message: "invalid arguments for " + name, Data: errs})
+	}
+}
@@ -0,0 +1,64 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"reflect"
+	"testing"
+)
+
+type signupInfo struct {
+	Email    string   `json:"email" validate:"required,pattern=^[^@]+@[^@,]+$"`
+	Nick     string   `json:"nick" validate:"min=3,max=8,username"`
+	Age      int      `json:"age" validate:"max=150"`
+	Spaces   []string `json:"spaces" validate:"ref"`
+	Referrer *refInfo `json:"referrer"`
+}
+
+type refInfo struct {
+	User string `json:"user" validate:"required,userref"`
+}
+
+func TestValidate(t *testing.T) {
+	sv := compileValidator(reflect.TypeOf(&signupInfo{}), map[reflect.Type]*structValidator{})
+	if sv == nil {
+		t.Fatal("expected a validator for signupInfo")
+	}
+	valid := &signupInfo{
+		Email:    "tav@espians.com",
+		Nick:     "tav",
+		Spaces:   []string{"#espra", "+tav"},
+		Referrer: &refInfo{"+olly"},
+	}
+	if errs := sv.validate(reflect.ValueOf(valid), "", nil); errs != nil {
+		t.Errorf("unexpected validation errors: %v", errs)
+	}
+	invalid := &signupInfo{
+		Nick:     "tav-espians",
+		Age:      200,
+		Spaces:   []string{"espra"},
+		Referrer: &refInfo{"olly"},
+	}
+	errs := sv.validate(reflect.ValueOf(invalid), "", nil)
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	expected := []string{"email", "nick", "age", "spaces", "referrer.user"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("got invalid fields %v, expected %v", fields, expected)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	type badTag struct {
+		Count int `validate:"username"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for the invalid validate tag")
+		}
+	}()
+	compileValidator(reflect.TypeOf(badTag{}), map[reflect.Type]*structValidator{})
+}
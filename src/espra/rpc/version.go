@@ -0,0 +1,103 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package rpc
+
+import (
+	"fmt"
+	"sort"
+)
+
+type serviceVersions []*service
+
+func (l serviceVersions) Len() int {
+	return len(l)
+}
+
+func (l serviceVersions) Less(i, j int) bool {
+	return l[i].version < l[j].version
+}
+
+func (l serviceVersions) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func addVersion(name string, s *service) {
+	if s.version < 1 {
+		panic(fmt.Sprintf("rpc: invalid version %d for `%s`", s.version, name))
+	}
+	for _, existing := range services[name] {
+		if existing.version == s.version {
+			panic(fmt.Sprintf("rpc: version %d of `%s` has already been registered", s.version, name))
+		}
+	}
+	versions := append(services[name], s)
+	sort.Sort(serviceVersions(versions))
+	services[name] = versions
+}
+
+// RegisterVersion registers v as a specific version of the
+// named service. Register is equivalent to registering version
+// 1. Clients select the version via the 'version' header field
+// and are given the latest version which isn't newer than it.
+// Clients which don't specify a version are given the oldest
+// one so that deployed clients continue to work.
+func RegisterVersion(name string, version int, v interface{}) *service {
+	return register(name, version, v, false)
+}
+
+func (ns Namespace) RegisterVersion(name string, version int, v interface{}) *service {
+	return register(string(ns)+"."+name, version, v, false)
+}
+
+// Deprecated marks the service version as deprecated. Calls to
+// it will have a warning, along with the optional notice,
+// added to the 'warnings' field of the response header.
+func (s *service) Deprecated(notice string) *service {
+	s.deprecated = true
+	s.notice = notice
+	return s
+}
+
+// lookup returns the version of the named service selected by
+// the 'version' header field.
+func (ctx *Context) lookup(name string) *service {
+	versions, exists := services[name]
+	if !exists {
+		Raise(ServiceNotFound, "service not found: %s", name)
+	}
+	s := versions[0]
+	if v, ok := ctx.Header["version"]; ok {
+		var version int
+		switch n := v.(type) {
+		case float64:
+			version = int(n)
+			if float64(version) != n {
+				version = 0
+			}
+		case int:
+			version = n
+		}
+		if version < 1 {
+			Raise(BadRequest, "'version' header field needs to be a positive integer")
+		}
+		s = nil
+		for _, sv := range versions {
+			if sv.version <= version {
+				s = sv
+			}
+		}
+		if s == nil {
+			Raise(ServiceNotFound, "service not found: %s (version %d)", name, version)
+		}
+	}
+	if s.deprecated && ctx.RespHeader != nil {
+		warning := fmt.Sprintf("version %d of %s is deprecated", s.version, name)
+		if s.notice != "" {
+			warning += ": " + s.notice
+		}
+		warnings, _ := ctx.RespHeader["warnings"].([]string)
+		ctx.RespHeader["warnings"] = append(warnings, warning)
+	}
+	return s
+}
@@ -0,0 +1,28 @@
+// Public Domain (-) 2013 The Espra Authors.
+// See the Espra UNLICENSE file for details.
+
+package espra
+
+import (
+	"espra/db"
+	"espra/kind"
+	"espra/rpc"
+)
+
+// The schemas of versioned kinds are registered here, rather
+// than in package db, so that db stays independent of rpc.
+// Changes to these structs need to bump the version by adding
+// an upgrade, e.g.
+//
+//	rpc.RegisterSchema(kind.User, &db.User{}).
+//		Upgrade(0, func(ctx *rpc.Context, key *rpc.Key, entity interface{}) error {
+//			user := entity.(*db.User)
+//			user.Location = strings.TrimSpace(user.Location)
+//			return nil
+//		})
+func init() {
+	rpc.RegisterSchema(kind.Account, &db.Account{})
+	rpc.RegisterSchema(kind.AccountLogin, &db.AccountLogin{})
+	rpc.RegisterSchema(kind.Content, &db.Content{})
+	rpc.RegisterSchema(kind.User, &db.User{})
+}